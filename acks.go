@@ -0,0 +1,150 @@
+package mq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/jump/uuid"
+)
+
+const (
+	// defaultAckTimeout is the time to wait for an acknowledgement when none has been configured
+	defaultAckTimeout = time.Second * 5
+	// defaultAckRetries is the number of times an acknowledged statement is sent again when none has been configured
+	defaultAckRetries = 10
+	// ackDedupWindows is the number of ack timeouts handled message ids are remembered for
+	ackDedupWindows = 10
+)
+
+// newAcks returns a pointer to a new instance of acks
+func newAcks() *acks {
+	return &acks{
+		pending: make(map[uuid.UUID]*pendingAck),
+		seen:    make(map[uuid.UUID]*seenAck),
+	}
+}
+
+// acks tracks acknowledged statements for a conn:
+//   - Sent statements are pending until the other side acknowledges them
+//   - Received statements are remembered by id so that retransmissions are not processed twice
+type acks struct {
+	mux sync.Mutex
+
+	// Sent statements awaiting acknowledgement
+	pending map[uuid.UUID]*pendingAck
+	// Received statements by id
+	seen map[uuid.UUID]*seenAck
+	// Last time handled ids were pruned
+	pruned time.Time
+}
+
+// pendingAck is a sent statement awaiting acknowledgement
+type pendingAck struct {
+	m msg
+	// Last time the statement was sent, zero when it has not been sent on the current net.Conn
+	sent time.Time
+	// Number of times the statement has been sent again
+	retries int
+}
+
+// seenAck is a received statement
+type seenAck struct {
+	// True once the statement has been processed
+	handled bool
+	// Time the statement was processed
+	at time.Time
+}
+
+// Put will add a statement which is about to be sent
+func (a *acks) Put(m msg) {
+	a.mux.Lock()
+	a.pending[m.id] = &pendingAck{m: m, sent: time.Now()}
+	a.mux.Unlock()
+}
+
+// Ack will remove an acknowledged statement
+func (a *acks) Ack(id uuid.UUID) {
+	a.mux.Lock()
+	delete(a.pending, id)
+	a.mux.Unlock()
+}
+
+// Due returns the pending statements which have not been sent within the provided timeout, they are marked as sent
+// Note: Statements which are due after being sent again the maximum number of retries are removed and returned
+// as expired
+func (a *acks) Due(timeout time.Duration, maxRetries int) (ms, expired []msg) {
+	a.mux.Lock()
+	now := time.Now()
+	for id, p := range a.pending {
+		if now.Sub(p.sent) < timeout {
+			continue
+		}
+
+		if p.retries >= maxRetries {
+			delete(a.pending, id)
+			expired = append(expired, p.m)
+			continue
+		}
+
+		p.sent = now
+		p.retries++
+		ms = append(ms, p.m)
+	}
+	a.mux.Unlock()
+	return
+}
+
+// Unsent will mark every pending statement as unsent, they are due immediately
+func (a *acks) Unsent() {
+	a.mux.Lock()
+	for _, p := range a.pending {
+		p.sent = time.Time{}
+	}
+	a.mux.Unlock()
+}
+
+// Receive will record a received statement, it returns false when the statement has already been received.
+// handled is true when the earlier statement has been processed
+func (a *acks) Receive(id uuid.UUID) (ok, handled bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if s, exists := a.seen[id]; exists {
+		return false, s.handled
+	}
+
+	a.seen[id] = &seenAck{}
+	return true, false
+}
+
+// Handled will mark a received statement as processed, handled ids older than the provided window are pruned
+func (a *acks) Handled(id uuid.UUID, window time.Duration) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	now := time.Now()
+	a.seen[id] = &seenAck{handled: true, at: now}
+	if now.Sub(a.pruned) < window {
+		return
+	}
+
+	for sid, s := range a.seen {
+		if s.handled && now.Sub(s.at) > window {
+			delete(a.seen, sid)
+		}
+	}
+
+	a.pruned = now
+}
+
+// Unhandled will forget received statements which have not been processed
+// Note: This is called when the inbound queue is replaced, so their retransmissions will be accepted
+func (a *acks) Unhandled() {
+	a.mux.Lock()
+	for id, s := range a.seen {
+		if !s.handled {
+			delete(a.seen, id)
+		}
+	}
+	a.mux.Unlock()
+}
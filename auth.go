@@ -1,11 +1,28 @@
 package mq
 
-import "sync"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+)
+
+const (
+	// nonceLen is the length of the nonce sent by the server during a challenge-response handshake
+	nonceLen = 32
+	// macLen is the length of the HMAC sent by the client during a challenge-response handshake
+	macLen = sha256.Size
+)
+
+// hsChallenge is sent in place of the token by clients requesting a challenge-response handshake
+// Note: Chunks created from non-empty strings never begin with a zero byte, so this cannot collide with a token
+var hsChallenge = Chunk{0, 'm', 'q', '-', 'c', 'h', 'a', 'l', 'l', 'e', 'n', 'g', 'e'}
 
 // newAuth returns a pointer to a new instance of auth
 func newAuth() *auth {
 	return &auth{
 		str: make(map[Chunk]Chunk),
+		rvk: make(map[Chunk]struct{}),
 	}
 }
 
@@ -16,6 +33,8 @@ type auth struct {
 
 	// Keyed by user's key with a value of the user's token
 	str map[Chunk]Chunk
+	// Keys which have been revoked, they are rejected before any Authenticator is called
+	rvk map[Chunk]struct{}
 }
 
 // Get will return a token and ok (whether or not it exists) for a provided key
@@ -27,12 +46,37 @@ func (a *auth) Get(key Chunk) (token Chunk, ok bool) {
 }
 
 // Put sets the store value for a provided key key to the provided token
+// Note: Keys which were revoked are restored
 func (a *auth) Put(key Chunk, token Chunk) {
 	a.mux.Lock()
 	a.str[key] = token
+	delete(a.rvk, key)
+	a.mux.Unlock()
+}
+
+// Revoke removes the entry in store which matches the provided key and marks the key as revoked
+func (a *auth) Revoke(key Chunk) {
+	a.mux.Lock()
+	delete(a.str, key)
+	a.rvk[key] = struct{}{}
 	a.mux.Unlock()
 }
 
+// Restore removes the provided key from the revoked keys
+func (a *auth) Restore(key Chunk) {
+	a.mux.Lock()
+	delete(a.rvk, key)
+	a.mux.Unlock()
+}
+
+// IsRevoked will return whether or not the provided key has been revoked
+func (a *auth) IsRevoked(key Chunk) (ok bool) {
+	a.mux.Lock()
+	_, ok = a.rvk[key]
+	a.mux.Unlock()
+	return
+}
+
 // Delete removes the entry in store which matches the provided key
 func (a *auth) Delete(key Chunk) {
 	a.mux.Lock()
@@ -40,15 +84,39 @@ func (a *auth) Delete(key Chunk) {
 	a.mux.Unlock()
 }
 
-// IsValid will validate the provided credentials
-func (a *auth) IsValid(h handshake) (ok bool) {
+// Authenticate will validate the provided handshake against the stored tokens
+// Note: Handshakes verified by client certificate are always allowed
+func (a *auth) Authenticate(h Handshake) (meta interface{}, ok bool) {
+	if h.Verified {
+		// Client certificate has already been verified, return early
+		return nil, true
+	}
+
 	var tkn Chunk
-	a.mux.Lock()
-	if tkn, ok = a.str[h.key]; ok {
-		ok = tkn == h.token
+	if tkn, ok = a.Get(h.Key); !ok {
+		// Key does not exist, return early
+		return
 	}
-	a.mux.Unlock()
 
-	// If tokens match, return true
+	// If provided credentials match our token, return true
+	ok = h.VerifyToken(tkn)
 	return
 }
+
+// newNonce returns a new random nonce to be used for a challenge-response handshake
+func newNonce() (nonce []byte, err error) {
+	nonce = make([]byte, nonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// challengeMAC returns the HMAC which proves knowledge of the token for the provided key and nonce
+func challengeMAC(key, token Chunk, nonce []byte) []byte {
+	h := hmac.New(sha256.New, token[:])
+	h.Write(nonce)
+	h.Write(key[:])
+	return h.Sum(nil)
+}
@@ -1,10 +1,13 @@
 package mq
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"sync/atomic"
 
 	"github.com/missionMeteora/jump/chanchan"
+	"github.com/missionMeteora/jump/uuid"
 	"github.com/missionMeteora/toolkit/errors"
 )
 
@@ -14,8 +17,12 @@ func NewClient(opts ClientOpts) (cl *Client, err error) {
 	cl = &Client{
 		dialb: Newdialback(6, 5),
 		loc:   opts.Loc,
+		tls:   opts.TLS,
 		op:    opts.Op,
+		chlg:  opts.Challenge,
+		ver:   protoCurrent,
 		errC:  chanchan.NewChanChan(4, 12, chanchan.FullPush),
+		done:  make(chan struct{}),
 	}
 
 	if cl.key, err = NewChunkFromString(opts.Name); err != nil {
@@ -26,15 +33,26 @@ func NewClient(opts ClientOpts) (cl *Client, err error) {
 		return
 	}
 
+	if opts.LegacyProtocol {
+		// Server does not support versioning, use the legacy handshake and wire format
+		cl.ver = protoV1
+	}
+
 	if cl.op == nil {
 		cl.op = NewOp(nil, nil)
 	}
 
-	cl.conn = newConn(Chunk{}, nil, NewOp(cl.op.OnConnect, cl.onDisconnect), nil, cl.errC)
+	co := newConnOpts(opts.Heartbeat, opts.HeartbeatMisses, opts.MaxBodySize)
+	co.setWorkers(opts.Workers, opts.OrderedStatements)
+	co.mws = opts.Middleware
+	co.dl = opts.DeadLetters
+	co.setAcks(opts.AckTimeout, opts.AckRetries)
+	co.resume = opts.ResumeRequests
+	cl.conn = newConn(Chunk{}, nil, NewReasonOp(cl.op.OnConnect, cl.onDisconnect), nil, cl.errC, co)
 
 	// Dial within a goroutine so that we don't hold up the initalization process
 	go func() {
-		if err := cl.Dial(); err != nil {
+		if err := cl.Dial(); err != nil && err != ErrClientIsClosed {
 			cl.errC.Send(err)
 			return
 		}
@@ -53,9 +71,18 @@ type Client struct {
 	token Chunk
 	op    Operator
 
+	// TLS configuration, plain TCP is used when nil
+	tls *tls.Config
+	// When true, the token is proven with a challenge-response handshake rather than being sent
+	chlg bool
+	// Protocol version requested during the handshake
+	ver uint8
+
 	// Internal full-access channel
 	errC *chanchan.ChanChan
 
+	// Closed when the client is closed, used to release Serve
+	done   chan struct{}
 	closed uint32
 }
 
@@ -63,44 +90,246 @@ func (c *Client) isClosed() bool {
 	return atomic.LoadUint32(&c.closed) == 1
 }
 
-func (c *Client) onDisconnect(key Chunk) {
+func (c *Client) onDisconnect(key Chunk, reason error) {
 	if c.isClosed() {
 		return
 	}
 
-	go c.op.OnDisconnect(key)
-	c.dialb.Wait()
-	c.Dial()
+	go notifyDisconnect(c.op, key, reason)
+	if reason == ErrRevoked {
+		// Our credentials have been revoked, attempting to reconnect would be futile
+		return
+	}
+
+	// Redial within a goroutine, the conn is still closing while we are being notified
+	go func() {
+		c.dialb.Wait()
+		if c.isClosed() {
+			// Client was closed while we were waiting, do not bring the conn back
+			return
+		}
+
+		if err := c.Dial(); err != nil && err != ErrClientIsClosed {
+			c.errC.Send(err)
+		}
+	}()
 }
 
 // Dial will connect to the server
+// Note: ErrClientIsClosed is returned when the client is closed before the connection is established
 func (c *Client) Dial() (err error) {
 	var (
 		nc net.Conn
 		id Chunk
+		p  proto
 	)
 
-	for nc, err = net.Dial("tcp", c.loc); err != nil; nc, err = net.Dial("tcp", c.loc) {
+	for nc, err = c.dial(); err != nil; nc, err = c.dial() {
 		// Waiting, then attempting to reconnect
 		c.dialb.Wait()
+		if c.isClosed() {
+			return ErrClientIsClosed
+		}
 	}
 
-	if id, err = clientHandshake(nc, c.key, c.token); err != nil {
+	if id, p, err = clientHandshake(nc, c.key, c.token, c.chlg, c.ver); err != nil {
 		// We encountered an error writing our handshake to the server.
+		nc.Close()
+		return
+	}
+
+	if c.isClosed() {
+		// Client was closed while we were dialing, refreshing would bring the closed conn back
+		nc.Close()
+		return ErrClientIsClosed
+	}
+
+	// Set new net.Conn. Dialed, shook hands, and toasted glasses. We can now set our status as "connected"
+	// Note: refreshSettings sets the conn as connected
+	if err = c.refreshSettings(id, nc, p); err != nil {
 		return
 	}
 
-	// Set new net.Conn
-	c.refreshSettings(id, nc)
+	if c.isClosed() {
+		// Client was closed while we were refreshing, close the conn again
+		c.conn.Close()
+		return ErrClientIsClosed
+	}
 
-	// Dialed, shook hands, and toasted glasses. We can now set our status as "connected"
-	c.setConnected()
+	// Restore our subscriptions, they were lost along with the previous net.Conn
+	for _, pattern := range c.subs.List() {
+		if err = c.subscription(statusSubscribe, pattern); err != nil {
+			c.errC.Send(err)
+			err = nil
+			break
+		}
+	}
 
 	// Reset the dialback
 	c.dialb.Reset()
 	return
 }
 
+// StatementTo is used to send a statement to another client, it is forwarded by the server
+func (c *Client) StatementTo(key string, b []byte) (err error) {
+	var m msg
+	if m, err = c.forwardMsg(mtStatement, key, b); err != nil {
+		return c.undeliverable(m, err)
+	}
+
+	return c.undeliverable(m, c.out.Put(m))
+}
+
+// RequestTo is used to send a request to another client, it is forwarded by the server
+// Note: fn is called with ErrTargetOffline when the other client is not connected
+func (c *Client) RequestTo(key string, b []byte, fn ReqErrFunc) (err error) {
+	var m msg
+	if m, err = c.forwardMsg(mtRequest, key, b); err != nil {
+		return c.undeliverable(m, err)
+	}
+
+	return c.undeliverable(m, c.request(m, fn, false))
+}
+
+// RequestToCtx is used to send a request to another client, it will block until the response is received
+// Note: ErrTargetOffline is returned when the other client is not connected
+func (c *Client) RequestToCtx(ctx context.Context, key string, b []byte) (resp []byte, err error) {
+	var m msg
+	if m, err = c.forwardMsg(mtRequest, key, b); err != nil {
+		return nil, c.undeliverable(m, err)
+	}
+
+	return c.requestCtx(ctx, m, false)
+}
+
+// forwardMsg returns a message to be forwarded by the server to the client with the provided key
+// Note: The message is returned along with ErrConnIsClosed so that it can be kept as a dead letter
+func (c *Client) forwardMsg(t msgType, key string, b []byte) (m msg, err error) {
+	var kC Chunk
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
+	}
+
+	// Prefix body with the key of the target client
+	body := make([]byte, 16+len(b))
+	copy(body, kC[:])
+	copy(body[16:], b)
+	m = msg{uuid.New(), t, statusForward, body}
+
+	switch {
+	case c.conn.isClosed():
+		err = ErrConnIsClosed
+	case !c.hasCap(capRoute):
+		err = ErrRouteNotSupported
+	}
+
+	return
+}
+
+// DeadLetters returns the messages which could not be delivered or processed, oldest first
+func (c *Client) DeadLetters() ([]DeadLetter, error) {
+	if c.co.dl == nil {
+		return nil, ErrNoDeadLetterSink
+	}
+
+	return c.co.dl.List()
+}
+
+// Replay will send a dead letter again and remove it from the dead-letter sink once it has been sent. fn is
+// called with the response to a replayed request, the response is discarded when fn is nil
+// Note: The dead letter is kept when it cannot be sent, inbound dead letters cannot be replayed
+func (c *Client) Replay(id uuid.UUID, fn ReqErrFunc) (err error) {
+	var dl DeadLetter
+	if dl, err = replayable(c.co.dl, id); err != nil {
+		return
+	}
+
+	t := mtStatement
+	if dl.Request {
+		t = mtRequest
+	}
+
+	m := msg{uuid.New(), t, statusOK, dl.Body}
+	if dl.Routed {
+		// Message was sent to another client, forward it through the server again
+		if m, err = c.forwardMsg(t, dl.Key.String(), dl.Body); err != nil {
+			return
+		}
+	}
+
+	if dl.Request {
+		err = c.request(m, replayFunc(fn), false)
+	} else {
+		err = c.send(m)
+	}
+
+	if err != nil {
+		return
+	}
+
+	return c.co.dl.Delete(id)
+}
+
+// Subscribe will subscribe to topics matching the provided pattern, fn is called with each message published to them
+// Note: Patterns consist of tokens separated by dots, a "*" token matches any single token and a final ">" token
+// matches one or more tokens. Subscriptions are restored after reconnecting. fn is called by the listener, so it
+// should not block
+func (c *Client) Subscribe(pattern string, fn TopicFunc) (err error) {
+	if !validTopic(pattern, true) {
+		return ErrInvalidTopic
+	}
+
+	c.subs.Put(pattern, fn)
+	if !c.conn.isConnected() {
+		// We will subscribe once connected
+		return
+	}
+
+	if err = c.subscription(statusSubscribe, pattern); err == ErrPubSubNotSupported {
+		c.subs.Delete(pattern)
+	}
+
+	return
+}
+
+// Unsubscribe will unsubscribe from the provided pattern
+func (c *Client) Unsubscribe(pattern string) (err error) {
+	c.subs.Delete(pattern)
+	if !c.conn.isConnected() {
+		return
+	}
+
+	return c.subscription(statusUnsubscribe, pattern)
+}
+
+// dial will open a net.Conn to the server, TLS is used when a TLS configuration exists
+func (c *Client) dial() (net.Conn, error) {
+	if c.tls == nil {
+		return net.Dial("tcp", c.loc)
+	}
+
+	return tls.Dial("tcp", c.loc, c.tls)
+}
+
+// Serve will process inbound messages from the server using the provided KeyReceiver, the key of the
+// server is passed along with each message. Serve blocks until the client is closed
+// Note: Receivers can be served by wrapping them with IgnoreKey. Messages continue to be served
+// after reconnecting. Serve should not be mixed with Receive, calling Serve again will replace the KeyReceiver
+func (c *Client) Serve(rec KeyReceiver) error {
+	if c.isClosed() {
+		return ErrClientIsClosed
+	}
+
+	c.co.sr.set(rec)
+	if c.conn.isConnected() {
+		// Start serving now, otherwise we are served once connected
+		c.startServe()
+	}
+
+	<-c.done
+	return nil
+}
+
 // ErrC returns a chanchan.Receiver interface which is backed by c.errC
 func (c *Client) ErrC() chanchan.Receiver {
 	return c.errC
@@ -123,39 +352,90 @@ func (c *Client) Close() error {
 		errs.Push(err)
 	}
 
+	// Fail requests which were kept to be resumed, we will not be reconnecting
+	c.deadRequests(c.rw.Dump())
+
 	// Close our error channel
 	if err := c.errC.Close(false); err != nil {
 		errs.Push(err)
 	}
 
+	// Release Serve
+	close(c.done)
+
 	return errs.Err()
 }
 
-// clientHandshake will use a key and token to send a handshake to the server
-func clientHandshake(nc net.Conn, key, token Chunk) (id Chunk, err error) {
-	var hs [32]byte
+// clientHandshake will use a key and token to send a handshake to the server, the negotiated protocol is returned
+// Note: When challenge is true, the token is never sent. Instead, an HMAC of the server-provided nonce is sent.
+// When ver is protoV1, the legacy handshake is used so that servers which do not support versioning can be reached
+func clientHandshake(nc net.Conn, key, token Chunk, challenge bool, ver uint8) (id Chunk, p proto, err error) {
+	var (
+		hs [48]byte
+		n  = 32
+	)
+
 	// Copy key to the first sixteen bytes
 	copy(hs[:16], key[:])
-	// Copy token to the last sixteen bytes
-	copy(hs[16:], token[:])
-	// Send handhshake to server
 
-	if _, err = nc.Write(hs[:]); err != nil {
+	switch {
+	case ver != protoV1:
+		var flags uint8
+		if challenge {
+			flags |= helloChallenge
+		} else {
+			// Copy token to the sixteen bytes following our hello
+			copy(hs[32:], token[:])
+			n = 48
+		}
+
+		// Copy hello to the second sixteen bytes
+		hello := newHello(ver, flags, capAll)
+		copy(hs[16:32], hello[:])
+	case challenge:
+		// Copy challenge request to the last sixteen bytes
+		copy(hs[16:32], hsChallenge[:])
+	default:
+		// Copy token to the last sixteen bytes
+		copy(hs[16:32], token[:])
+	}
+
+	// Send handhshake to server
+	if _, err = nc.Write(hs[:n]); err != nil {
 		return
 	}
 
 	var m msg
 	// Read handshake message
-	if m, err = readMsg(nc); err != nil {
+	if m, err = readMsg(nc, ver); err != nil {
 		return
 	}
 
+	if challenge && m.s == statusChallenge {
+		// Server has provided a nonce, respond with our HMAC and read the resulting handshake message
+		if _, err = nc.Write(challengeMAC(key, token, m.body)); err != nil {
+			return
+		}
+
+		if m, err = readMsg(nc, ver); err != nil {
+			return
+		}
+	}
+
 	// Switch on handshake status
 	switch m.s {
 	case statusInvalid:
 		err = ErrInvalidMsgHeader
 	case statusForbidden:
 		err = ErrForbidden
+	case statusVersion:
+		if len(m.body) != 2 {
+			err = ErrInvalidMsgLength
+			break
+		}
+
+		// Our protocol version is not supported, the server has provided the range it supports
+		err = &VersionError{Version: ver, Min: m.body[0], Max: m.body[1]}
 	case statusOK:
 		// Everything is good, move along now
 	default:
@@ -164,8 +444,8 @@ func clientHandshake(nc net.Conn, key, token Chunk) (id Chunk, err error) {
 	}
 
 	if err == nil {
-		// We have no errors, get id from message body and return it!
-		id, err = NewChunk(m.body)
+		// We have no errors, get id and negotiated protocol from message body and return them!
+		id, p, err = parseHelloResp(m.body, ver, capAll)
 	}
 
 	return
@@ -0,0 +1,144 @@
+package mq
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/missionMeteora/binny.v2"
+)
+
+var (
+	// JSONCodec encodes bodies as JSON
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes bodies using encoding/gob
+	GobCodec Codec = gobCodec{}
+	// BinnyCodec encodes bodies using binny
+	BinnyCodec Codec = binnyCodec{}
+
+	// DefaultCodec is used by Call and Handle
+	DefaultCodec = JSONCodec
+)
+
+// Codec is used to encode and decode message bodies
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// jsonCodec is a Codec which uses encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// gobCodec is a Codec which uses encoding/gob
+// Note: Each body is encoded with a new gob.Encoder, so type information is sent with every message
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) (b []byte, err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(v); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// binnyCodec is a Codec which uses binny
+type binnyCodec struct{}
+
+func (binnyCodec) Marshal(v interface{}) ([]byte, error) {
+	return binny.Marshal(v)
+}
+
+func (binnyCodec) Unmarshal(b []byte, v interface{}) error {
+	return binny.Unmarshal(b, v)
+}
+
+// Requester is used to make requests which wait for their response, it is implemented by Client
+type Requester interface {
+	RequestCtx(ctx context.Context, b []byte) ([]byte, error)
+}
+
+// NewEndpoint returns an Endpoint for the provided method, DefaultCodec is used when cdc is nil
+func NewEndpoint[Req, Resp any](method string, cdc Codec) *Endpoint[Req, Resp] {
+	if cdc == nil {
+		cdc = DefaultCodec
+	}
+
+	return &Endpoint[Req, Resp]{method: method, cdc: cdc}
+}
+
+// Endpoint declares the method, body types and Codec of a request once, so that they are shared by
+// the requester and the handler
+type Endpoint[Req, Resp any] struct {
+	method string
+	cdc    Codec
+}
+
+// Method returns the method name of the endpoint
+func (e *Endpoint[Req, Resp]) Method() string {
+	return e.method
+}
+
+// Call will encode the request, send it to the method using the provided Requester and decode the response
+// Note: Errors returned by the handler are returned as a ResponseError
+func (e *Endpoint[Req, Resp]) Call(ctx context.Context, r Requester, req Req) (resp Resp, err error) {
+	var b []byte
+	if b, err = e.cdc.Marshal(req); err != nil {
+		return
+	}
+
+	if b, err = NewMethodMsg(e.method, b); err != nil {
+		return
+	}
+
+	if b, err = r.RequestCtx(ctx, b); err != nil {
+		return
+	}
+
+	err = e.cdc.Unmarshal(b, &resp)
+	return
+}
+
+// Handle will register the provided func as the handler for the method
+// Note: Requests which cannot be decoded are answered with the decoding error
+func (e *Endpoint[Req, Resp]) Handle(mux *Mux, fn func(key Chunk, req Req) (Resp, error)) error {
+	return mux.HandleFunc(e.method, func(key Chunk, b []byte) (_ []byte, err error) {
+		var (
+			req  Req
+			resp Resp
+		)
+
+		if err = e.cdc.Unmarshal(b, &req); err != nil {
+			return
+		}
+
+		if resp, err = fn(key, req); err != nil {
+			return
+		}
+
+		return e.cdc.Marshal(resp)
+	}, nil)
+}
+
+// Call will send a request to the method using DefaultCodec and return the decoded response
+func Call[Req, Resp any](ctx context.Context, r Requester, method string, req Req) (Resp, error) {
+	return NewEndpoint[Req, Resp](method, nil).Call(ctx, r, req)
+}
+
+// Handle will register the provided func as the handler for the method using DefaultCodec
+func Handle[Req, Resp any](mux *Mux, method string, fn func(key Chunk, req Req) (Resp, error)) error {
+	return NewEndpoint[Req, Resp](method, nil).Handle(mux, fn)
+}
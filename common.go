@@ -18,7 +18,7 @@ const (
 )
 
 // status indicates the status of an inbound message.
-// Note: Messages with statusOK or statusError are the only messages which expect a body
+// Note: Messages with statusOK, statusError or a publish/subscribe status are the only messages which expect a body
 type status uint8
 
 const (
@@ -36,12 +36,32 @@ const (
 	statusInvalid
 	// statusDupConn is returned when the provided key is already connected to a server
 	statusDupConn
+	// statusChallenge is sent with a nonce when a client requests a challenge-response handshake
+	statusChallenge
+	// statusVersion is sent with the range of supported versions when a client's protocol version is not supported
+	statusVersion
+	// statusSubscribe is sent with a topic pattern when a client subscribes
+	statusSubscribe
+	// statusUnsubscribe is sent with a topic pattern when a client unsubscribes
+	statusUnsubscribe
+	// statusPublish is sent with a topic and body when a message is published to a subscribed topic
+	statusPublish
+	// statusForward is sent by a client with the key of the target client prefixing the body
+	statusForward
+	// statusForwarded is sent by the server with the key of the sending client prefixing the body
+	statusForwarded
+	// statusReliable is sent with statements which must be acknowledged once processed
+	statusReliable
+	// statusAck acknowledges the statement with the same id
+	statusAck
+	// statusUndeliverable is sent by the server with the reason and body of a forwarded statement which could not be delivered
+	statusUndeliverable
 )
 
 const (
 	// HeaderLen is the static length of message headers, it consists of:
 	// - UUID: 16 bytes
-	// - Body len: 8 bytes
+	// - Body len: 8 bytes (little-endian, native byte order for legacy peers)
 	// - Message type: 1 byte
 	// - Message status: 1 byte
 	HeaderLen = 26
@@ -1,11 +1,12 @@
 package mq
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
-	"unsafe"
+	"time"
 
 	"github.com/missionMeteora/iodb"
 	"github.com/missionMeteora/jump/chanchan"
@@ -13,29 +14,130 @@ import (
 	"github.com/missionMeteora/toolkit/errors"
 )
 
+// defaultHeartbeatMisses is the number of missed heartbeats allowed when none has been configured
+const defaultHeartbeatMisses = 3
+
+// maxHandshakeBody is the maximum body size of messages read during the initialization process
+const maxHandshakeBody = 4096
+
+// newConnOpts returns connOpts for the provided heartbeat interval, misses and maximum body size
+func newConnOpts(hb time.Duration, hbMisses int, maxBody int64) (co connOpts) {
+	co.hb = hb
+	co.maxBody = maxBody
+	co.sr = &servingRec{}
+	if co.hbMisses = int32(hbMisses); co.hbMisses <= 0 {
+		co.hbMisses = defaultHeartbeatMisses
+	}
+
+	return
+}
+
+// connOpts are the options shared by every conn belonging to a Server or Client
+type connOpts struct {
+	// Interval between heartbeat pings, heartbeats are disabled when zero
+	hb time.Duration
+	// Number of consecutive missed heartbeats allowed before the conn is closed
+	hbMisses int32
+	// Maximum inbound message body size, unlimited when zero
+	maxBody int64
+	// KeyReceiver serving inbound messages, set by Serve
+	sr *servingRec
+	// Worker slots used when serving, messages are processed one at a time when nil
+	// Note: Slots are shared by every conn of a Server
+	workers chan struct{}
+	// When true, served statements are processed in order rather than by workers
+	ordStmnts bool
+	// Middleware called before the KeyReceiver for every inbound message
+	mws []Middleware
+	// When true, subscriptions are removed when the conn is refreshed
+	resetSubs bool
+	// Routes forwarded messages to their target, nil when the conn does not route
+	route func(from *conn, m msg) error
+	// Time to wait for an acknowledgement before an acknowledged statement is sent again
+	ackTimeout time.Duration
+	// Number of times an acknowledged statement is sent again before it is dropped
+	ackRetries int
+	// When true, pending requests are resumed after reconnecting rather than failed
+	resume bool
+	// Sink for messages which could not be delivered or processed, nil when dead letters are not kept
+	dl DeadLetterSink
+}
+
+// deadLetter will store the provided dead letter when a dead-letter sink is set
+func (co *connOpts) deadLetter(dl DeadLetter) (err error) {
+	if co.dl == nil {
+		return
+	}
+
+	return co.dl.Put(dl)
+}
+
+// setAcks will set the time to wait for an acknowledgement and the number of times an acknowledged statement
+// is sent again, the defaults are used when zero
+func (co *connOpts) setAcks(d time.Duration, retries int) {
+	if co.ackTimeout = d; co.ackTimeout <= 0 {
+		co.ackTimeout = defaultAckTimeout
+	}
+
+	if co.ackRetries = retries; co.ackRetries <= 0 {
+		co.ackRetries = defaultAckRetries
+	}
+}
+
+// setWorkers will set the number of workers used when serving and whether statements are processed in order
+func (co *connOpts) setWorkers(n int, ordStmnts bool) {
+	if n > 0 {
+		co.workers = make(chan struct{}, n)
+	}
+
+	co.ordStmnts = ordStmnts
+}
+
+// servingRec holds the KeyReceiver serving inbound messages for every conn of a Server or Client
+type servingRec struct {
+	mux sync.RWMutex
+	rec KeyReceiver
+}
+
+// get returns the serving KeyReceiver, rec is nil when Serve has not been called
+func (s *servingRec) get() (rec KeyReceiver) {
+	s.mux.RLock()
+	rec = s.rec
+	s.mux.RUnlock()
+	return
+}
+
+// set will set the serving KeyReceiver
+func (s *servingRec) set(rec KeyReceiver) {
+	s.mux.Lock()
+	s.rec = rec
+	s.mux.Unlock()
+}
+
 // newConn returns a pointer to a new instance of conn
-func newConn(id Chunk, nc net.Conn, op Operator, db *iodb.DB, errC *chanchan.ChanChan) *conn {
+func newConn(id Chunk, nc net.Conn, op Operator, db *iodb.DB, errC *chanchan.ChanChan, co connOpts) *conn {
 	c := conn{
 		id: id,
 		nc: nc,
 
 		db: db,
+		co: co,
 
 		// Inbound message queue with a len of four and a capacity of thirty-two
 		in: newMsgQueue(4, 32),
 		// Outbound message queue with a len of four and a capacity of thirty-two
 		out: newMsgQueue(4, 32),
 
-		rw: newReqWait(),
-		pl: newPool(),
+		rw:   newReqWait(),
+		pl:   newPool(),
+		subs: newSubs(),
+		acks: newAcks(),
 
 		op: op,
 
 		errC: errC,
 	}
 
-	//db.CreateBucket("mq", id.String())
-
 	return &c
 }
 
@@ -46,18 +148,32 @@ type conn struct {
 
 	// TCP connection for conn
 	nc net.Conn
+	// Protocol version negotiated for nc
+	ver uint8
+	// Capabilities negotiated for nc, accessed atomically
+	caps uint32
 	// net.Conn mutex
 	ncm sync.Mutex
 
 	db *iodb.DB
+	co connOpts
 
-	// Inbound message queue
+	// Metadata provided by the Authenticator, protected by the net.Conn mutex
+	meta interface{}
+
+	// Inbound message queue, replaced when the conn is refreshed. Use inbound to access it
 	in *msgQueue
+	// Inbound message queue mutex
+	inm sync.RWMutex
 	// Outbound message queue
 	out *msgQueue
 
 	// Request func manager
 	rw *reqWait
+	// Topic subscriptions
+	subs *subs
+	// Acknowledged statements
+	acks *acks
 	// Byteslice pool
 	pl pool
 
@@ -78,15 +194,21 @@ type conn struct {
 	//	- One represents a connected state
 	//	- Two represents a closed state
 	state uint32
+
+	// Generation of the connection, incremented each time the conn is set as connected
+	gen uint32
+	// Number of heartbeats sent since the last inbound message
+	missed int32
+	// Serving state, one represents an active serve loop
+	serving uint32
+	// Pinging state, one represents a ping waiting to be put in the outbound queue
+	pinging uint32
+	// Number of queue group requests awaiting a response, accessed atomically
+	inflight int32
 }
 
-func (c *conn) refreshSettings(id Chunk, nc net.Conn) (err error) {
+func (c *conn) refreshSettings(id Chunk, nc net.Conn, p proto) (err error) {
 	c.ncm.Lock()
-	if c.isClosed() {
-		c.ncm.Unlock()
-		return ErrConnIsClosed
-	}
-
 	c.out.Close(false)
 	c.sm.Lock()
 	c.out = newMsgQueue(4, 32)
@@ -97,8 +219,28 @@ func (c *conn) refreshSettings(id Chunk, nc net.Conn) (err error) {
 	}
 
 	c.lm.Lock()
+	if c.isClosed() {
+		// Inbound queue was closed along with the previous net.Conn, replace it
+		// Note: Serve and Receive loops may be accessing the queue, so it's replaced under the lock
+		c.inm.Lock()
+		c.in = newMsgQueue(4, 32)
+		c.inm.Unlock()
+		// Acknowledged statements within the previous queue were not processed, accept them again
+		c.acks.Unhandled()
+	}
+
+	// Acknowledged statements may not have reached the other side, send them again on the new net.Conn
+	c.acks.Unsent()
+
+	if c.co.resetSubs {
+		// Subscriptions belong to the previous net.Conn, the other side will restore them
+		c.subs.Reset()
+	}
+
 	c.id = id
 	c.nc = nc
+	c.ver = p.ver
+	atomic.StoreUint32(&c.caps, p.caps)
 	c.ncm.Unlock()
 	atomic.SwapUint32(&c.state, 0)
 
@@ -106,7 +248,31 @@ func (c *conn) refreshSettings(id Chunk, nc net.Conn) (err error) {
 	c.lm.Unlock()
 	c.sm.Unlock()
 
-	return c.setConnected()
+	if err = c.setConnected(); err != nil {
+		return
+	}
+
+	// Send requests which were pending when the previous net.Conn was lost
+	for _, m := range c.rw.Requeue() {
+		c.out.Put(m)
+	}
+
+	return
+}
+
+// setMeta sets the metadata for the connection
+func (c *conn) setMeta(meta interface{}) {
+	c.ncm.Lock()
+	c.meta = meta
+	c.ncm.Unlock()
+}
+
+// getMeta returns the metadata for the connection
+func (c *conn) getMeta() (meta interface{}) {
+	c.ncm.Lock()
+	meta = c.meta
+	c.ncm.Unlock()
+	return
 }
 
 func (c *conn) listener() {
@@ -132,14 +298,30 @@ func (c *conn) listener() {
 			break
 		}
 
+		// We have heard from the other side, reset our missed heartbeats
+		atomic.StoreInt32(&c.missed, 0)
+
 		// Message type is located at the twenty-forth index of the buffer
 		m.t = msgType(buf[24])
 
+		// Message status is located at the twenty-fifth index of the buffer
+		m.s = status(buf[25])
+
 		// Copy index zero to index sixteen (not includeding) to the message id (passed as a slice)
 		copy(m.id[:], buf[:16])
 
 		// Set body length by reading eight bytes of the buffer starting at index sixteen
-		if blen = *(*int64)(unsafe.Pointer(&buf[16])); blen > 0 {
+		if blen = int64(byteOrder(c.ver).Uint64(buf[16:24])); blen < 0 {
+			// Top bit of the body length is set, the stream cannot be trusted from this point on
+			sendMsg(c.nc, c.ver, mtStatement, statusInvalid, nil)
+			err = ErrInvalidMsgLength
+			break
+		} else if c.co.maxBody > 0 && blen > c.co.maxBody {
+			// Body length exceeds our maximum, reject the message before allocating anything
+			sendMsg(c.nc, c.ver, mtStatement, statusInvalid, nil)
+			err = &BodySizeError{Key: c.id, Size: blen, Max: c.co.maxBody}
+			break
+		} else if blen > 0 {
 			// Body length  is greater than zero
 
 			// Set m.Body by getting a slice from the pool for our needed length
@@ -152,9 +334,12 @@ func (c *conn) listener() {
 		}
 
 		// Process message, if an error is encountered:
+		//	- Break if our access has been revoked
 		//	- Send message to error chan
 		//	- We don't need to kill connection because of an invalid message type, set err to nil
-		if err = c.process(m); err != nil {
+		if err = c.process(m); err == ErrRevoked {
+			break
+		} else if err != nil {
 			c.errC.Send(err)
 			err = nil
 		}
@@ -170,7 +355,7 @@ func (c *conn) listener() {
 		}
 	}
 
-	go c.Close()
+	go c.close(err)
 
 	if err != io.EOF {
 		// If we have an error which does not equal io.EOF, send it to the error chan
@@ -191,13 +376,27 @@ func (c *conn) sender() {
 	)
 
 	for m, err = c.out.Get(); err == nil; m, err = c.out.Get() {
+		if !c.isConnected() {
+			// Conn was closed or refreshed before the message was written, keep it as a dead letter
+			c.unsent(m)
+			continue
+		}
+
 		// Set buf using slice pool
-		buf, n = m.Bytes(c.pl.Get(int64(HeaderLen + len(m.body))))
+		buf, n = m.Bytes(c.pl.Get(int64(HeaderLen+len(m.body))), c.ver)
 		// Write buf to net.Conn
 		_, err = c.nc.Write(buf[:n])
 		// Return buf to slice pool
 		c.pl.Put(buf)
 
+		if err != nil {
+			// Message could not be written, keep it as a dead letter
+			c.unsent(m)
+		} else if m.t == mtRequest && c.co.resume {
+			// Request has reached the net.Conn, it can no longer be safely resent unless it's idempotent
+			c.rw.Sent(m.id)
+		}
+
 		// If our connection is closed, set the error to io.EOF
 		if !c.isConnected() {
 			err = io.EOF
@@ -214,17 +413,111 @@ func (c *conn) sender() {
 
 // Process handles inbound messages and determines which actions need to be taken
 func (c *conn) process(m msg) (err error) {
+	// Switch on message status
+	switch m.s {
+	case statusForbidden:
+		// Our access has been revoked by the other side, return ErrRevoked
+		return ErrRevoked
+	case statusPing:
+		// Other side is checking if we are still here, respond with a pong
+		return c.out.Put(msg{id: m.id, t: mtStatement, s: statusPong})
+	case statusPong:
+		// Missed heartbeats were reset when the message was read, nothing else to do
+		return
+	case statusInvalid:
+		// Other side has rejected one of our messages
+		return ErrMsgRejected
+	case statusSubscribe:
+		// Other side is subscribing to a topic pattern
+		if pattern := string(m.body); validTopic(pattern, true) {
+			c.subs.Put(pattern, nil)
+		}
+
+		return
+	case statusUnsubscribe:
+		// Other side is unsubscribing from a topic pattern
+		c.subs.Delete(string(m.body))
+		return
+	case statusAck:
+		// Other side has processed one of our acknowledged statements
+		c.acks.Ack(m.id)
+		return
+	case statusReliable:
+		// Other side expects an acknowledgement once this statement is processed
+		if ok, handled := c.acks.Receive(m.id); !ok {
+			if handled {
+				// Statement was processed, our acknowledgement must have been lost
+				return c.out.Put(msg{id: m.id, t: mtStatement, s: statusAck})
+			}
+
+			// Statement is waiting to be processed, drop the retransmission
+			return
+		}
+	case statusUndeliverable:
+		// Statement we sent to another client through the server could not be delivered, keep it as a dead letter
+		var (
+			reason string
+			body   []byte
+		)
+
+		if reason, body, err = ParseMethodMsg(m.body); err != nil {
+			return
+		} else if len(body) < 16 {
+			return ErrInvalidMsgLength
+		}
+
+		ue := &UndeliverableError{Err: ResponseError(reason)}
+		copy(ue.Key[:], body[:16])
+		c.putDeadLetter(newDeadLetter(c.id, msg{m.id, mtStatement, statusForward, body}, ue.Err))
+		return ue
+	case statusForward:
+		// Other side is sending a message to another client through us
+		if c.co.route == nil {
+			// Only servers route messages
+			return ErrInvalidstatus
+		}
+
+		return c.co.route(c, m)
+	case statusPublish:
+		// Message has been published to a topic we are subscribed to
+		var (
+			topic string
+			body  []byte
+		)
+
+		if topic, body, err = ParseMethodMsg(m.body); err != nil {
+			return
+		}
+
+		fns, _ := c.subs.Match(topic)
+		for _, fn := range fns {
+			fn(topic, body)
+		}
+
+		return
+	}
+
 	// Switch on message type
 	switch m.t {
 	case mtRequest, mtStatement:
 		// Put message in inbound queue
 		// We do not return body to pool until we are finished using it
-		return c.in.Put(m)
+		if err = c.inbound().Put(m); err == nil {
+			return
+		}
+
+		// Inbound queue has been closed, the message is kept as a dead letter below
 	case mtResponse:
 		// Get request function for provided message id
 		if fn, ok := c.rw.Get(m.id); ok {
+			if m.s == statusError {
+				// Responder failed, call fn with the provided error message
+				fn(nil, ResponseError(m.body))
+				return
+			}
+
 			// Call fn with message body as an argument
-			fn(m.body)
+			fn(m.body, nil)
 			// We do not return body to pool until we are finished using it
 			return
 		}
@@ -236,6 +529,11 @@ func (c *conn) process(m msg) (err error) {
 		err = ErrInvalidmsgType
 	}
 
+	// Message could not be processed, keep it as a dead letter
+	dl := newDeadLetter(c.id, m, err)
+	dl.Inbound = true
+	c.putDeadLetter(dl)
+
 	if m.body != nil {
 		// Body exists, return it to the pool
 		c.pl.Put(m.body)
@@ -259,9 +557,153 @@ func (c *conn) setConnected() error {
 	go c.listener()
 	// Start sender loop in a new go routine
 	go c.sender()
+
+	gen := atomic.AddUint32(&c.gen, 1)
+	if c.co.hb > 0 && c.hasCap(capHeartbeat) {
+		// Heartbeats are enabled and supported by the other side, start heartbeat loop in a new go routine
+		go c.heartbeat(gen)
+	}
+
+	if c.hasCap(capAck) {
+		// Start retransmit loop in a new go routine
+		go c.retransmit(gen)
+	}
+
+	// Start serve loop when a KeyReceiver is serving
+	c.startServe()
 	return nil
 }
 
+// retransmit will send acknowledged statements again when they have not been acknowledged within the ack timeout
+// Note: Unsent statements are sent immediately. Statements which are not acknowledged after the maximum number
+// of retries are dropped and kept as dead letters. The loop exits once the conn is no longer connected with the
+// provided generation
+func (c *conn) retransmit(gen uint32) {
+	tkr := time.NewTicker(c.co.ackTimeout)
+	defer tkr.Stop()
+
+	for {
+		if !c.isConnected() || atomic.LoadUint32(&c.gen) != gen {
+			// Connection has been closed or refreshed, return
+			return
+		}
+
+		due, expired := c.acks.Due(c.co.ackTimeout, c.co.ackRetries)
+		for _, m := range due {
+			c.out.Put(m)
+		}
+
+		for _, m := range expired {
+			// Other side has not acknowledged the statement, stop sending it
+			c.errC.Send(ErrNotAcknowledged)
+			c.putDeadLetter(newDeadLetter(c.id, m, ErrNotAcknowledged))
+		}
+
+		<-tkr.C
+	}
+}
+
+// startServe will start the serve loop in a new go routine, if a KeyReceiver is serving and no loop is active
+func (c *conn) startServe() {
+	if c.co.sr.get() == nil || !atomic.CompareAndSwapUint32(&c.serving, 0, 1) {
+		return
+	}
+
+	go c.serve()
+}
+
+// serve will process inbound messages using the serving KeyReceiver until the conn is closed
+func (c *conn) serve() {
+	for {
+		for c.dispatch() == nil {
+		}
+
+		atomic.StoreUint32(&c.serving, 0)
+		// Note: The conn may have reconnected while we were exiting. When it has, startServe lost
+		// the race to our still active loop, so we continue serving the refreshed inbound queue
+		if !c.isConnected() || !atomic.CompareAndSwapUint32(&c.serving, 0, 1) {
+			return
+		}
+	}
+}
+
+// dispatch will process the next inbound message using the serving KeyReceiver
+// Note: When workers are configured, the message is processed within a worker and dispatch only blocks while
+// every worker is busy. Statements are processed before returning when they must be processed in order
+func (c *conn) dispatch() (err error) {
+	if c.co.workers == nil {
+		return c.receive(c.co.sr.get())
+	}
+
+	if c.isClosed() {
+		return ErrConnIsClosed
+	}
+
+	var m msg
+	// Get next message from inbound queue
+	if m, err = c.inbound().Get(); err != nil {
+		return
+	}
+
+	if m.t == mtStatement && c.co.ordStmnts {
+		return c.handle(c.co.sr.get(), m)
+	}
+
+	// Acquire worker, then process message within a new go routine
+	c.co.workers <- struct{}{}
+	go func(rec KeyReceiver) {
+		c.handle(rec, m)
+		<-c.co.workers
+	}(c.co.sr.get())
+
+	return
+}
+
+// heartbeat will send a ping every heartbeat interval. The conn is closed when the other side
+// does not send anything for more than the allowed number of missed heartbeats
+// Note: The loop exits once the conn is no longer connected with the provided generation
+func (c *conn) heartbeat(gen uint32) {
+	tkr := time.NewTicker(c.co.hb)
+	defer tkr.Stop()
+
+	atomic.StoreInt32(&c.missed, 0)
+	for range tkr.C {
+		if !c.isConnected() || atomic.LoadUint32(&c.gen) != gen {
+			// Connection has been closed or refreshed, return
+			return
+		}
+
+		if atomic.AddInt32(&c.missed, 1) > c.co.hbMisses {
+			// Other side has not responded, assume the connection is dead
+			c.errC.Send(ErrHeartbeat)
+			c.close(ErrHeartbeat)
+			return
+		}
+
+		if atomic.CompareAndSwapUint32(&c.pinging, 0, 1) {
+			// Ping without blocking, the outbound queue may be full when the other side stops reading
+			// Note: Pings are skipped while a previous ping is still waiting to be queued
+			go func(out *msgQueue) {
+				out.Put(msg{id: uuid.New(), t: mtStatement, s: statusPing})
+				atomic.StoreUint32(&c.pinging, 0)
+			}(c.out)
+		}
+	}
+}
+
+// inbound returns the current inbound message queue
+func (c *conn) inbound() (in *msgQueue) {
+	c.inm.RLock()
+	in = c.in
+	c.inm.RUnlock()
+	return
+}
+
+// hasCap returns whether or not the provided capability was negotiated with the other side
+func (c *conn) hasCap(cp uint32) bool {
+	return atomic.LoadUint32(&c.caps)&cp != 0
+}
+
 func (c *conn) isReady() bool {
 	return atomic.LoadUint32(&c.state) == 0
 }
@@ -276,37 +718,230 @@ func (c *conn) isClosed() bool {
 
 // Statement is a message which does not expect nor accept a response
 func (c *conn) Statement(b []byte) (err error) {
+	m := msg{uuid.New(), mtStatement, statusOK, b}
+	return c.undeliverable(m, c.send(m))
+}
+
+// send will put the provided message in the outbound queue
+func (c *conn) send(m msg) error {
+	if c.isClosed() {
+		return ErrConnIsClosed
+	}
+
+	return c.out.Put(m)
+}
+
+// undeliverable will keep an outbound message as a dead letter when reason is an undeliverable error, reason is returned
+func (c *conn) undeliverable(m msg, reason error) error {
+	if reason != nil && isUndeliverable(reason) {
+		c.putDeadLetter(newDeadLetter(c.id, m, reason))
+	}
+
+	return reason
+}
+
+// unsent will keep an outbound statement which was not written before the conn was closed or refreshed as a
+// dead letter. Requests are kept by deadRequests once they have been failed
+func (c *conn) unsent(m msg) {
+	if m.t == mtStatement {
+		c.closedDeadLetter(m)
+	}
+}
+
+// deadRequests will keep the provided requests, which were failed with ErrConnIsClosed, as dead letters
+func (c *conn) deadRequests(ms []msg) {
+	for _, m := range ms {
+		c.closedDeadLetter(m)
+	}
+}
+
+// closedDeadLetter will keep the provided message as a dead letter with ErrConnIsClosed as the reason
+// Note: Acknowledged statements are sent again and messages forwarded on behalf of other clients can only be
+// replayed by their sender, so neither is kept
+func (c *conn) closedDeadLetter(m msg) {
+	if c.co.dl == nil || (m.s != statusOK && m.s != statusForward) {
+		return
+	}
+
+	c.putDeadLetter(newDeadLetter(c.id, m, ErrConnIsClosed))
+}
+
+// putDeadLetter will store the provided dead letter, errors encountered while storing are sent to the error chan
+func (c *conn) putDeadLetter(dl DeadLetter) {
+	if err := c.co.deadLetter(dl); err != nil {
+		c.errC.Send(err)
+	}
+}
+
+// StatementAck is a statement which the other side acknowledges once it has been processed. It is sent again
+// when it is not acknowledged within the ack timeout, including after reconnecting, until it is acknowledged.
+// Once it has been sent again the maximum number of retries, it is dropped, ErrNotAcknowledged is sent to the
+// error chan and it is kept as a dead letter
+// Note: The other side ignores retransmissions of statements it has already processed, so each statement is
+// processed at least once and usually exactly once. b must not be modified after calling StatementAck
+func (c *conn) StatementAck(b []byte) (err error) {
+	if c.isClosed() {
+		return ErrConnIsClosed
+	}
+
+	if !c.hasCap(capAck) {
+		return ErrAckNotSupported
+	}
+
+	m := msg{uuid.New(), mtStatement, statusReliable, b}
+	c.acks.Put(m)
+	// Note: Statements which cannot be queued remain pending, they are sent by the retransmit loop
+	c.out.Put(m)
+	return
+}
+
+// publish will send a message which has been published to a topic, b is created by NewMethodMsg
+func (c *conn) publish(b []byte) (err error) {
 	if c.isClosed() {
 		return ErrConnIsClosed
 	}
 
-	return c.out.Put(msg{uuid.New(), mtStatement, statusOK, b})
+	return c.out.Put(msg{uuid.New(), mtStatement, statusPublish, b})
+}
+
+// subscription will notify the other side of a subscription change, s is statusSubscribe or statusUnsubscribe
+func (c *conn) subscription(s status, pattern string) (err error) {
+	if c.isClosed() {
+		return ErrConnIsClosed
+	}
+
+	if !c.hasCap(capPubSub) {
+		return ErrPubSubNotSupported
+	}
+
+	return c.out.Put(msg{uuid.New(), mtStatement, s, []byte(pattern)})
 }
 
 // Request is a message which expects a response
 func (c *conn) Request(b []byte, fn ReqFunc) (err error) {
+	return c.RequestErr(b, func(b []byte, _ error) { fn(b) })
+}
+
+// RequestErr is a message which expects a response, fn will be called with an error when the response fails
+func (c *conn) RequestErr(b []byte, fn ReqErrFunc) (err error) {
+	m := msg{uuid.New(), mtRequest, statusOK, b}
+	return c.undeliverable(m, c.request(m, fn, false))
+}
+
+// RequestIdempotent is a request which is safe to process more than once. When pending requests are resumed
+// after reconnecting, it is sent again rather than failing with ErrConnLost
+func (c *conn) RequestIdempotent(b []byte, fn ReqErrFunc) (err error) {
+	m := msg{uuid.New(), mtRequest, statusOK, b}
+	return c.undeliverable(m, c.request(m, fn, true))
+}
+
+// RequestIdempotentCtx is a request which is safe to process more than once, it will block until the response
+// is received. See RequestIdempotent and RequestCtx for details
+func (c *conn) RequestIdempotentCtx(ctx context.Context, b []byte) (resp []byte, err error) {
+	return c.requestCtx(ctx, msg{uuid.New(), mtRequest, statusOK, b}, true)
+}
+
+// request will send the provided request message, fn will be called with the response
+// Note: idem is only used when pending requests are resumed after reconnecting
+func (c *conn) request(m msg, fn ReqErrFunc, idem bool) (err error) {
 	if c.isClosed() {
 		return ErrConnIsClosed
 	}
 
-	m := msg{uuid.New(), mtRequest, statusOK, b}
-	c.rw.Put(m.id, fn)
-	c.out.Put(m)
+	if c.co.resume {
+		c.rw.PutResumable(m, fn, idem)
+	} else {
+		c.rw.Put(m, fn)
+	}
+
+	if err = c.out.Put(m); err != nil {
+		// Message could not be queued, remove response func
+		c.rw.Get(m.id)
+	}
 
 	return
 }
 
+// RequestCtx is a message which expects a response, it will block until the response is received
+// Note: If the context is done before the response arrives, the context's error is returned. If the
+// connection is closed before the response arrives, ErrConnIsClosed is returned. If the responder
+// fails, a ResponseError is returned
+func (c *conn) RequestCtx(ctx context.Context, b []byte) (resp []byte, err error) {
+	return c.requestCtx(ctx, msg{uuid.New(), mtRequest, statusOK, b}, false)
+}
+
+// requestCtx will send the provided request message and block until the response is received
+func (c *conn) requestCtx(ctx context.Context, m msg, idem bool) (resp []byte, err error) {
+	return waitResp(ctx, func(fn ReqErrFunc) error {
+		return c.undeliverable(m, c.request(m, fn, idem))
+	}, func() {
+		// Remove response func so it does not linger until the connection closes
+		c.rw.Get(m.id)
+	})
+}
+
+// waitResp will send a request using send and block until the response func it was given is called
+// Note: If the context is done first, cancel is called and the context's error is returned
+func waitResp(ctx context.Context, send func(ReqErrFunc) error, cancel func()) (resp []byte, err error) {
+	type result struct {
+		body []byte
+		err  error
+	}
+
+	// Buffered so that the response func never blocks, even when we are no longer waiting
+	rc := make(chan result, 1)
+	if err = send(func(b []byte, err error) {
+		rc <- result{b, err}
+	}); err != nil {
+		return
+	}
+
+	select {
+	case r := <-rc:
+		return r.body, r.err
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+}
+
+// Receive will process the next inbound message using the provided Receiver
 func (c *conn) Receive(rec Receiver) (err error) {
+	return c.ReceiveErr(errRec{rec})
+}
+
+// ReceiveErr will process the next inbound message using the provided ErrReceiver
+// Note: Errors returned by the ErrReceiver are sent to the requester as a ResponseError
+func (c *conn) ReceiveErr(rec ErrReceiver) (err error) {
+	return c.receive(keyRec{rec})
+}
+
+// receive will process the next inbound message using the provided KeyReceiver
+func (c *conn) receive(rec KeyReceiver) (err error) {
 	if c.isClosed() {
 		return ErrConnIsClosed
 	}
 
 	var m msg
 	// Get next message from inbound queue
-	if m, err = c.in.Get(); err != nil {
+	if m, err = c.inbound().Get(); err != nil {
 		return
 	}
 
+	return c.handle(rec, m)
+}
+
+// handle will process an inbound message using the provided KeyReceiver
+func (c *conn) handle(rec KeyReceiver, m msg) (err error) {
+	// Pass message through middleware before the KeyReceiver
+	h := chain(c.co.mws, rec)
+	info := MsgInfo{Key: c.id, ID: m.id, Request: m.t == mtRequest}
+	if m.s == statusForwarded && len(m.body) >= 16 {
+		// Message was forwarded by the server, it is prefixed with the key of the sending client
+		copy(info.Key[:], m.body[:16])
+		m.body = m.body[16:]
+	}
+
 	// For supported message types:
 	// We are going to assume that the end-user is going to hold onto the message body,
 	// like a child who is five years old and still carries their Teddy everywhere.
@@ -314,13 +949,17 @@ func (c *conn) Receive(rec Receiver) (err error) {
 	// and NOT returning the byteslice to the pool.
 	switch m.t {
 	case mtRequest:
-		err = c.out.Put(msg{
-			id:   m.id, // Use same id as requesting message to match on the other side
-			t:    mtResponse,
-			body: rec.Response(m.body), // Process body and return result to responding body
-		})
+		// Process body and return result to responding body
+		// Note: Use same id as requesting message to match on the other side
+		body, rerr := h(info, m.body)
+		err = c.respond(m.id, body, rerr)
 	case mtStatement:
-		rec.Statement(m.body)
+		h(info, m.body)
+		if m.s == statusReliable {
+			// Statement has been processed, acknowledge it
+			c.acks.Handled(m.id, c.co.ackTimeout*ackDedupWindows)
+			err = c.out.Put(msg{id: m.id, t: mtStatement, s: statusAck})
+		}
 	default:
 		// This message type is invalid, return message body to pool
 		c.pl.Put(m.body)
@@ -329,8 +968,45 @@ func (c *conn) Receive(rec Receiver) (err error) {
 	return
 }
 
+// respond will send a response for the request with the provided id, a non-nil rerr is sent in place of the body
+func (c *conn) respond(id uuid.UUID, body []byte, rerr error) error {
+	resp := msg{
+		id: id,
+		t:  mtResponse,
+	}
+
+	if rerr == nil {
+		resp.body = body
+	} else if c.hasCap(capErrResponse) {
+		// Response failed, send error message with a status of Error
+		resp.s = statusError
+		resp.body = []byte(rerr.Error())
+	}
+
+	// Note: When the other side does not understand error responses, failed responses are sent without a body
+	return c.out.Put(resp)
+}
+
 // Close will close the conn and return a list of errors it encounters in the process
 func (c *conn) Close() error {
+	return c.close(nil)
+}
+
+// revoke will notify the other side that it's access has been revoked, then close the conn
+func (c *conn) revoke() error {
+	c.ncm.Lock()
+	if c.nc != nil && c.isConnected() {
+		// Note: The notice is written directly to the net.Conn because the outbound queue
+		// is not guaranteed to be flushed before closing
+		sendMsg(c.nc, c.ver, mtStatement, statusForbidden, nil)
+	}
+	c.ncm.Unlock()
+
+	return c.close(ErrRevoked)
+}
+
+// close will close the conn with the provided reason and return a list of errors it encounters in the process
+func (c *conn) close(reason error) error {
 	if atomic.SwapUint32(&c.state, 2) == 2 {
 		// We are already closed, so we can return at this point
 		return ErrConnIsClosed
@@ -339,25 +1015,33 @@ func (c *conn) Close() error {
 	var errs errors.ErrorList
 	// Close outbound channel, we are not waiting for close because acquiring c.sm lock will ensure closure
 	errs.Push(c.out.Close(false))
-	c.sm.Lock()
 
 	// Lock and close net.Conn to avoid additional inbound messages
+	// Note: This is done before acquiring c.sm, the sender may be blocked writing to a dead net.Conn. Remaining
+	// outbound messages are kept as dead letters rather than written, so nothing is lost by closing it first
 	c.ncm.Lock()
 	if c.nc != nil {
 		errs.Push(c.nc.Close())
 	}
 	c.ncm.Unlock()
 
+	c.sm.Lock()
+
 	// Close inbound channel, we are not waiting for close because acquiring c.lm lock will ensure closure
-	errs.Push(c.in.Close(true))
+	errs.Push(c.inbound().Close(true))
 
 	c.lm.Lock()
-	// Dump remaining waiting funcs
-	c.rw.Dump()
+	if c.co.resume && reason != nil && reason != ErrRevoked {
+		// Connection was lost and will be redialed, keep the requests which can be resumed
+		c.deadRequests(c.rw.Lost())
+	} else {
+		// Dump remaining waiting funcs
+		c.deadRequests(c.rw.Dump())
+	}
 
 	if c.op != nil {
 		// Operator exists, send notification to OnDisconnect
-		c.op.OnDisconnect(c.id)
+		notifyDisconnect(c.op, c.id, reason)
 	}
 
 	c.lm.Unlock()
@@ -368,7 +1052,7 @@ func (c *conn) Close() error {
 
 // readMsg is used as a under the hood helper function utilized during the initialization process
 // This is NOT intended to be used once the listener loop begins.
-func readMsg(nc net.Conn) (m msg, err error) {
+func readMsg(nc net.Conn, ver uint8) (m msg, err error) {
 	var (
 		buf [HeaderLen]byte // Header buffer
 		n   int             // Amount read
@@ -396,7 +1080,11 @@ func readMsg(nc net.Conn) (m msg, err error) {
 	//if m.s != statusOK || m.s !=
 
 	// Set body length by reading eight bytes of the buffer starting at index sixteen
-	if blen := *(*int64)(unsafe.Pointer(&buf[16])); blen > 0 {
+	if blen := int64(byteOrder(ver).Uint64(buf[16:24])); blen < 0 || blen > maxHandshakeBody {
+		// Initialization messages are small, anything larger (or negative) is invalid
+		err = ErrInvalidMsgLength
+		return
+	} else if blen > 0 {
 		// Body length  is greater than zero
 
 		// Set m.Body by getting a slice from the pool for our needed length
@@ -417,7 +1105,7 @@ func readMsg(nc net.Conn) (m msg, err error) {
 
 // sendMsg is used as a under the hood helper function utilized during the initialization process
 // This is NOT intended to be used once the sender loop begins.
-func sendMsg(nc net.Conn, t msgType, s status, b []byte) (err error) {
+func sendMsg(nc net.Conn, ver uint8, t msgType, s status, b []byte) (err error) {
 	m := msg{
 		t:    t,
 		s:    s,
@@ -425,7 +1113,7 @@ func sendMsg(nc net.Conn, t msgType, s status, b []byte) (err error) {
 	}
 
 	// Set buf using slice pool
-	buf, n := m.Bytes(make([]byte, int64(HeaderLen+len(m.body))))
+	buf, n := m.Bytes(make([]byte, int64(HeaderLen+len(m.body))), ver)
 	// Write buf to net.Conn
 	_, err = nc.Write(buf[:n])
 	return
@@ -4,13 +4,16 @@ import (
 	"net"
 	"sync"
 
+	"github.com/missionMeteora/iodb"
 	"github.com/missionMeteora/jump/chanchan"
+	"github.com/missionMeteora/jump/uuid"
 )
 
 // newConns returns a pointer to a new instance of conns
-func newConns() *conns {
+func newConns(co connOpts) *conns {
 	return &conns{
-		m: make(map[Chunk]*conn),
+		m:  make(map[Chunk]*conn),
+		co: co,
 	}
 }
 
@@ -20,6 +23,10 @@ type conns struct {
 
 	// Internal store of connections
 	m map[Chunk]*conn
+	// Options for new connections
+	co connOpts
+	// Spool for keys which are not connected, nil when disabled
+	sp *spool
 }
 
 // Get will return a conn which matches the provided key. If no match is available, set ok to false
@@ -30,8 +37,9 @@ func (c *conns) Get(k Chunk) (out *conn, ok bool) {
 	return
 }
 
-// Put inserts a conn for the provided key
-func (c *conns) Put(k Chunk, nc net.Conn, op Operator, errC *chanchan.ChanChan) (err error) {
+// Put inserts a conn for the provided key. hello is called before the conn is started, so that the
+// handshake response is written before any other message
+func (c *conns) Put(k Chunk, nc net.Conn, p proto, op Operator, meta interface{}, errC *chanchan.ChanChan, hello func() error) (err error) {
 	var (
 		cc *conn
 		ok bool
@@ -43,17 +51,55 @@ func (c *conns) Put(k Chunk, nc net.Conn, op Operator, errC *chanchan.ChanChan)
 		err = ErrConnExists
 	} else {
 		// No conn exists for this entry, create a new one
-		cc = newConn(k, nil, op, nil, errC)
+		cc = newConn(k, nil, op, c.db(), errC, c.co)
 		// Set new conn as entry for provided key
 		c.m[k] = cc
 	}
 
-	// At this point, we have a conn. We need to call refreshSettings on it
-	err = cc.refreshSettings(k, nc)
+	// Send the handshake response, the conn's sender has not been started so nothing can be written before it
+	if err = hello(); err == nil {
+		// At this point, we have a conn. We need to set it's metadata and call refreshSettings on it
+		cc.setMeta(meta)
+		if err = cc.refreshSettings(k, nc, p); err == nil && c.sp != nil {
+			// Send spooled statements before any others, the lock is held so that new statements wait
+			err = c.sp.Flush(k, cc)
+		}
+	}
+
 	c.mux.Unlock()
 	return
 }
 
+// Statement sends a statement to the conn for the provided key. When the conn is not connected and spooling
+// is enabled, the statement is spooled for keys which have connected before or are known
+func (c *conns) Statement(k Chunk, b []byte, known bool) (err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cc, ok := c.m[k]
+	switch {
+	case ok && cc.isConnected():
+		return cc.send(msg{uuid.New(), mtStatement, statusOK, b})
+	case c.sp != nil && (ok || known):
+		// Note: The lock is held so that the key cannot reconnect before the statement is spooled
+		return c.sp.Put(k, b)
+	case !ok:
+		// Connection does not exist, return ErrConnDoesNotExist
+		return ErrConnDoesNotExist
+	default:
+		return cc.send(msg{uuid.New(), mtStatement, statusOK, b})
+	}
+}
+
+// db returns the iodb.DB backing the spool, nil when spooling is disabled
+func (c *conns) db() *iodb.DB {
+	if c.sp == nil {
+		return nil
+	}
+
+	return c.sp.db
+}
+
 // Delete removes a connection from the list
 func (c *conns) Delete(k Chunk) {
 	c.mux.Lock()
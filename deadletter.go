@@ -0,0 +1,291 @@
+package mq
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/iodb"
+	"github.com/missionMeteora/jump/chanchan"
+	"github.com/missionMeteora/jump/uuid"
+)
+
+// DeadLetter is a message which could not be delivered or processed
+type DeadLetter struct {
+	// Id of the dead letter, used to replay it
+	ID uuid.UUID
+	// Key of the connection the message was sent to (or received from when inbound)
+	// Note: For routed messages, this is the key of the target client
+	Key Chunk
+	// True when the message was received and could not be processed, inbound dead letters cannot be replayed
+	Inbound bool
+	// True when the message is a request
+	Request bool
+	// True when the message was sent to another client through the server
+	Routed bool
+	// Body of the original message
+	Body []byte
+	// Reason the message could not be delivered or processed
+	Reason string
+	// Time the message became a dead letter
+	At time.Time
+}
+
+// newDeadLetter returns a DeadLetter for the provided message, the body is copied
+// Note: Forwarded messages are stored with the key of their target and without the key prefix
+func newDeadLetter(key Chunk, m msg, reason error) (dl DeadLetter) {
+	dl.ID = uuid.New()
+	dl.Key = key
+	dl.Request = m.t == mtRequest
+	dl.Reason = reason.Error()
+	dl.At = time.Now()
+
+	body := m.body
+	if m.s == statusForward && len(body) >= 16 {
+		dl.Routed = true
+		copy(dl.Key[:], body[:16])
+		body = body[16:]
+	}
+
+	dl.Body = make([]byte, len(body))
+	copy(dl.Body, body)
+	return
+}
+
+// isUndeliverable returns whether or not the provided error means a message could not be delivered
+func isUndeliverable(err error) bool {
+	switch err.(type) {
+	case *SpoolFullError:
+		return true
+	}
+
+	switch err {
+	case ErrConnDoesNotExist, ErrConnIsClosed, ErrTargetOffline, chanchan.ErrIsClosed:
+		return true
+	}
+
+	return false
+}
+
+// DeadLetterSink stores dead letters so that they can be inspected and replayed
+type DeadLetterSink interface {
+	// Put will store the provided dead letter
+	Put(dl DeadLetter) error
+	// Get returns the dead letter with the provided id, ErrDeadLetterDoesNotExist is returned when it does not exist
+	Get(id uuid.UUID) (DeadLetter, error)
+	// List returns every stored dead letter, oldest first
+	List() ([]DeadLetter, error)
+	// Delete will remove the dead letter with the provided id
+	Delete(id uuid.UUID) error
+}
+
+// replayable returns the dead letter with the provided id from the sink, when it can be replayed
+func replayable(dls DeadLetterSink, id uuid.UUID) (dl DeadLetter, err error) {
+	if dls == nil {
+		err = ErrNoDeadLetterSink
+		return
+	}
+
+	if dl, err = dls.Get(id); err != nil {
+		return
+	}
+
+	if dl.Inbound {
+		err = ErrDeadLetterInbound
+	}
+
+	return
+}
+
+// NewMemDeadLetters returns a pointer to a new instance of MemDeadLetters
+// Note: When more than max dead letters are stored, the oldest is discarded. Unlimited when zero
+func NewMemDeadLetters(max int) *MemDeadLetters {
+	return &MemDeadLetters{
+		max: max,
+	}
+}
+
+// MemDeadLetters is an in-memory DeadLetterSink, dead letters are lost when the process exits
+type MemDeadLetters struct {
+	mux sync.RWMutex
+	// Dead letters, oldest first
+	dls []DeadLetter
+	// Maximum number of dead letters, unlimited when zero
+	max int
+}
+
+// Put will store the provided dead letter, the oldest dead letter is discarded when the maximum is reached
+func (m *MemDeadLetters) Put(dl DeadLetter) error {
+	m.mux.Lock()
+	if m.max > 0 && len(m.dls) >= m.max {
+		m.dls = append(m.dls[:0], m.dls[len(m.dls)-m.max+1:]...)
+	}
+
+	m.dls = append(m.dls, dl)
+	m.mux.Unlock()
+	return nil
+}
+
+// Get returns the dead letter with the provided id
+func (m *MemDeadLetters) Get(id uuid.UUID) (dl DeadLetter, err error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	for _, dl = range m.dls {
+		if dl.ID == id {
+			return
+		}
+	}
+
+	return DeadLetter{}, ErrDeadLetterDoesNotExist
+}
+
+// List returns every stored dead letter, oldest first
+func (m *MemDeadLetters) List() (dls []DeadLetter, err error) {
+	m.mux.RLock()
+	dls = make([]DeadLetter, len(m.dls))
+	copy(dls, m.dls)
+	m.mux.RUnlock()
+	return
+}
+
+// Delete will remove the dead letter with the provided id
+func (m *MemDeadLetters) Delete(id uuid.UUID) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for i, dl := range m.dls {
+		if dl.ID == id {
+			m.dls = append(m.dls[:i], m.dls[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrDeadLetterDoesNotExist
+}
+
+// NewDBDeadLetters returns a pointer to a new instance of DBDeadLetters, backed by an iodb.DB at the provided path
+func NewDBDeadLetters(path string) (d *DBDeadLetters, err error) {
+	d = &DBDeadLetters{}
+	if d.db, err = iodb.New(path); err != nil {
+		return nil, err
+	}
+
+	if d.bkt, err = d.db.CreateBucket("mq", "deadLetters"); err != nil {
+		d.db.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// DBDeadLetters is a DeadLetterSink backed by iodb, dead letters are kept across restarts
+// Note: Entry keys are prefixed with the time the message became a dead letter, so they are iterated in order
+type DBDeadLetters struct {
+	mux sync.Mutex
+
+	db  *iodb.DB
+	bkt *iodb.Bucket
+}
+
+// Put will store the provided dead letter
+func (d *DBDeadLetters) Put(dl DeadLetter) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.bkt.Put(deadLetterKey(dl), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(dl)
+	})
+}
+
+// Get returns the dead letter with the provided id
+func (d *DBDeadLetters) Get(id uuid.UUID) (dl DeadLetter, err error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	var ok bool
+	if dl, _, ok, err = d.find(id); err == nil && !ok {
+		err = ErrDeadLetterDoesNotExist
+	}
+
+	return
+}
+
+// List returns every stored dead letter, oldest first
+func (d *DBDeadLetters) List() (dls []DeadLetter, err error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	err = d.bkt.ForEach(func(_ string, r io.Reader) (err error) {
+		var dl DeadLetter
+		if err = gob.NewDecoder(r).Decode(&dl); err != nil {
+			return
+		}
+
+		dls = append(dls, dl)
+		return
+	})
+
+	return
+}
+
+// Delete will remove the dead letter with the provided id
+func (d *DBDeadLetters) Delete(id uuid.UUID) (err error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	var (
+		ek string
+		ok bool
+	)
+
+	if _, ek, ok, err = d.find(id); err != nil {
+		return
+	} else if !ok {
+		return ErrDeadLetterDoesNotExist
+	}
+
+	return d.bkt.Delete(ek)
+}
+
+// Close will close the underlying iodb.DB
+func (d *DBDeadLetters) Close() error {
+	return d.db.Close()
+}
+
+// find returns the dead letter and entry key for the provided id, ok is false when it does not exist
+// Note: The lock must be held by the caller
+func (d *DBDeadLetters) find(id uuid.UUID) (dl DeadLetter, ek string, ok bool, err error) {
+	suffix := fmt.Sprintf("-%x", id[:])
+	err = d.bkt.ForEach(func(key string, r io.Reader) (err error) {
+		if ok || !strings.HasSuffix(key, suffix) {
+			return
+		}
+
+		if err = gob.NewDecoder(r).Decode(&dl); err != nil {
+			return
+		}
+
+		ek, ok = key, true
+		return
+	})
+
+	return
+}
+
+// deadLetterKey returns the entry key of the provided dead letter
+func deadLetterKey(dl DeadLetter) string {
+	return fmt.Sprintf("%020d-%x", dl.At.UnixNano(), dl.ID[:])
+}
+
+// replayFunc returns fn, or a func which discards the response when fn is nil
+func replayFunc(fn ReqErrFunc) ReqErrFunc {
+	if fn == nil {
+		return func([]byte, error) {}
+	}
+
+	return fn
+}
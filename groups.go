@@ -0,0 +1,117 @@
+package mq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// newGroups returns a pointer to a new instance of groups
+func newGroups() *groups {
+	return &groups{
+		m: make(map[string]*group),
+	}
+}
+
+// groups manages the queue groups of a Server
+type groups struct {
+	mux sync.RWMutex
+
+	// Groups by name
+	m map[string]*group
+}
+
+// group is a queue group, each message sent to the group is delivered to one of it's members
+type group struct {
+	// Keys of the members
+	keys []Chunk
+	// Index of the member to start with when picking, incremented on each pick
+	next uint32
+}
+
+// Join will add the provided key to a group, the group is created when it does not exist
+func (g *groups) Join(name string, key Chunk) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	grp, ok := g.m[name]
+	if !ok {
+		grp = &group{}
+		g.m[name] = grp
+	}
+
+	for _, k := range grp.keys {
+		if k == key {
+			// Key is already a member
+			return
+		}
+	}
+
+	grp.keys = append(grp.keys, key)
+}
+
+// Leave will remove the provided key from a group, the group is removed when it has no members
+func (g *groups) Leave(name string, key Chunk) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	grp, ok := g.m[name]
+	if !ok {
+		return
+	}
+
+	for i, k := range grp.keys {
+		if k == key {
+			grp.keys = append(grp.keys[:i:i], grp.keys[i+1:]...)
+			break
+		}
+	}
+
+	if len(grp.keys) == 0 {
+		delete(g.m, name)
+	}
+}
+
+// Members returns the keys of the members of a group
+func (g *groups) Members(name string) (keys []Chunk) {
+	g.mux.RLock()
+	if grp, ok := g.m[name]; ok {
+		keys = append(keys, grp.keys...)
+	}
+	g.mux.RUnlock()
+	return
+}
+
+// Pick returns the connected member of a group with the fewest requests in flight, ties are broken
+// round-robin. Members whose keys are within skip are not picked
+func (g *groups) Pick(name string, cs *conns, skip map[Chunk]struct{}) (c *conn, err error) {
+	g.mux.RLock()
+	defer g.mux.RUnlock()
+
+	grp, ok := g.m[name]
+	if !ok {
+		return nil, ErrGroupDoesNotExist
+	}
+
+	start := int(atomic.AddUint32(&grp.next, 1))
+	for i := range grp.keys {
+		key := grp.keys[(start+i)%len(grp.keys)]
+		if _, ok = skip[key]; ok {
+			continue
+		}
+
+		mc, ok := cs.Get(key)
+		if !ok || !mc.isConnected() {
+			continue
+		}
+
+		if c == nil || atomic.LoadInt32(&mc.inflight) < atomic.LoadInt32(&c.inflight) {
+			c = mc
+		}
+	}
+
+	if c == nil {
+		err = ErrNoGroupMembers
+	}
+
+	return
+}
@@ -0,0 +1,204 @@
+package mq
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+const (
+	// protoV1 is the original wire format, body lengths are encoded using the host's native byte order
+	// Note: This is only used to communicate with peers which do not send a hello
+	protoV1 uint8 = 1
+	// protoV2 encodes body lengths as little-endian, regardless of the host's byte order
+	protoV2 uint8 = 2
+	// protoV3 adds capabilities to the hello and to the server's handshake response
+	protoV3 uint8 = 3
+
+	// protoCurrent is the newest protocol version supported
+	protoCurrent = protoV3
+)
+
+const (
+	// helloChallenge is set in the hello flags when the client requests a challenge-response handshake
+	helloChallenge uint8 = 1 << iota
+)
+
+const (
+	// capHeartbeat is set when a peer answers heartbeat pings
+	capHeartbeat uint32 = 1 << iota
+	// capErrResponse is set when a peer understands error responses
+	capErrResponse
+	// capPubSub is set when a peer supports publish/subscribe
+	capPubSub
+	// capRoute is set when a peer supports routing messages between clients
+	capRoute
+	// capAck is set when a peer acknowledges statements
+	capAck
+
+	// capAll represents every capability supported
+	capAll = capHeartbeat | capErrResponse | capPubSub | capRoute | capAck
+)
+
+// proto is the protocol negotiated with a peer
+type proto struct {
+	// Protocol version
+	ver uint8
+	// Capabilities supported by both sides
+	caps uint32
+}
+
+// legacyProto is used with peers which do not support versioning
+var legacyProto = proto{ver: protoV1}
+
+// impliedCaps returns the capabilities implied by a protocol version which predates capabilities
+func impliedCaps(ver uint8) uint32 {
+	switch ver {
+	case protoV1:
+		return 0
+	case protoV2:
+		// Heartbeats and error responses predate protoV2
+		return capHeartbeat | capErrResponse
+	default:
+		return capAll
+	}
+}
+
+// helloMagic is the prefix of a hello, it is sent in place of the token by clients which support versioning
+// Note: Chunks created from non-empty strings never begin with a zero byte, so this cannot collide with a token
+var helloMagic = [4]byte{0, 'm', 'q', 'h'}
+
+// nativeOrder is the byte order of the host, it is used by protoV1
+var nativeOrder = getNativeOrder()
+
+// getNativeOrder returns the byte order of the host
+func getNativeOrder() binary.ByteOrder {
+	v := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&v))[0] == 1 {
+		return binary.LittleEndian
+	}
+
+	return binary.BigEndian
+}
+
+// byteOrder returns the byte order used to encode body lengths for the provided protocol version
+func byteOrder(ver uint8) binary.ByteOrder {
+	if ver == protoV1 {
+		// Legacy peers use their native byte order
+		return nativeOrder
+	}
+
+	return binary.LittleEndian
+}
+
+// newHello returns a hello for the provided protocol, flags and capabilities
+// Hello layout:
+//   - Magic: 4 bytes
+//   - Protocol version: 1 byte
+//   - Flags: 1 byte
+//   - Capabilities: 4 bytes (little-endian, protoV3 and newer)
+//   - Reserved: 6 bytes
+func newHello(ver, flags uint8, caps uint32) (h Chunk) {
+	copy(h[:4], helloMagic[:])
+	h[4] = ver
+	h[5] = flags
+	if ver >= protoV3 {
+		binary.LittleEndian.PutUint32(h[6:10], caps)
+	}
+
+	return
+}
+
+// parseHello returns the protocol version, flags and capabilities of a hello, ok is false when the chunk is not a hello
+func parseHello(h Chunk) (ver, flags uint8, caps uint32, ok bool) {
+	if h[0] != helloMagic[0] || h[1] != helloMagic[1] || h[2] != helloMagic[2] || h[3] != helloMagic[3] {
+		return
+	}
+
+	if ver, flags = h[4], h[5]; ver >= protoV3 {
+		caps = binary.LittleEndian.Uint32(h[6:10])
+	} else {
+		caps = impliedCaps(ver)
+	}
+
+	ok = true
+	return
+}
+
+// negotiate returns the protocol to be used with a peer supporting up to the provided version and capabilities
+func negotiate(ver uint8, caps uint32) (p proto) {
+	switch {
+	case ver > protoCurrent:
+		// Peer is newer than us, downgrade to our newest version
+		p.ver = protoCurrent
+	case ver < protoV2:
+		// Versioning was introduced with protoV2, anything older is a legacy peer
+		p.ver = protoV1
+	default:
+		p.ver = ver
+	}
+
+	// Only capabilities supported by both sides are used
+	p.caps = caps & capAll
+	return
+}
+
+// newHelloResp returns the body of the server's handshake response for the provided protocol
+// Response layout:
+//   - Server ID: 16 bytes
+//   - Protocol version: 1 byte (protoV2 and newer)
+//   - Capabilities: 4 bytes (little-endian, protoV3 and newer)
+func newHelloResp(id Chunk, p proto) (b []byte) {
+	switch {
+	case p.ver == protoV1:
+		return id[:]
+	case p.ver == protoV2:
+		return append(id[:], p.ver)
+	default:
+		b = append(id[:], p.ver, 0, 0, 0, 0)
+		// Note: The negotiated capabilities are sent, so capabilities we have disabled are not used by the client
+		binary.LittleEndian.PutUint32(b[17:], p.caps)
+		return
+	}
+}
+
+// parseHelloResp returns the server ID and negotiated protocol from the server's handshake response
+// Note: ver is the protocol version requested by the client
+func parseHelloResp(b []byte, ver uint8, caps uint32) (id Chunk, p proto, err error) {
+	switch {
+	case ver == protoV1:
+		id, err = NewChunk(b)
+		p = legacyProto
+		return
+	case len(b) < 17:
+		// Body should contain at least the server's ID followed by the negotiated protocol version
+		err = ErrInvalidMsgLength
+		return
+	}
+
+	id, _ = NewChunk(b[:16])
+	if p.ver = b[16]; p.ver > ver || p.ver < protoV2 {
+		// Server has selected a version we did not ask for
+		err = &VersionError{Version: p.ver, Min: protoV2, Max: ver}
+		return
+	}
+
+	if p.ver < protoV3 {
+		p.caps = impliedCaps(p.ver) & caps
+		return
+	}
+
+	if len(b) != 21 {
+		// Body should contain the server's capabilities following the protocol version
+		err = ErrInvalidMsgLength
+		return
+	}
+
+	// Only capabilities supported by both sides are used
+	p.caps = binary.LittleEndian.Uint32(b[17:]) & caps
+	return
+}
+
+// newVersionResp returns the body of a version rejection for the provided range of supported versions
+func newVersionResp(min, max uint8) []byte {
+	return []byte{min, max}
+}
@@ -0,0 +1,107 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/missionMeteora/jump/uuid"
+)
+
+// MsgInfo describes an inbound message being processed
+type MsgInfo struct {
+	// Key of the sending node
+	Key Chunk
+	// ID of the message, responses share the ID of their request
+	ID uuid.UUID
+	// True when the message is a request, false when it's a statement
+	Request bool
+}
+
+// MsgHandler processes an inbound message. The returned body and error are only used for requests
+type MsgHandler func(info MsgInfo, b []byte) ([]byte, error)
+
+// Middleware wraps the processing of inbound messages, it is called before the Receiver
+// Note: Middleware must call next to continue processing the message
+type Middleware func(next MsgHandler) MsgHandler
+
+// chain returns a MsgHandler which passes messages through the provided middleware before the KeyReceiver
+// Note: The first middleware is the outermost, it is called first
+func chain(mws []Middleware, rec KeyReceiver) (h MsgHandler) {
+	h = func(info MsgInfo, b []byte) ([]byte, error) {
+		if info.Request {
+			return rec.Response(info.Key, b)
+		}
+
+		rec.Statement(info.Key, b)
+		return nil, nil
+	}
+
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+
+	return
+}
+
+// PanicError is sent to the requester when a Receiver panics while processing a request
+type PanicError struct {
+	// Value passed to panic
+	Value interface{}
+}
+
+// Error returns the error message
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic while processing message: %v", e.Value)
+}
+
+// Recover returns Middleware which recovers from panics, the panic is returned as a *PanicError
+// Note: The requester receives the panic as a ResponseError
+func Recover() Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(info MsgInfo, b []byte) (resp []byte, err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					resp, err = nil, &PanicError{Value: v}
+				}
+			}()
+
+			return next(info, b)
+		}
+	}
+}
+
+// Log returns Middleware which logs each message along with it's processing time and error
+func Log(l *log.Logger) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(info MsgInfo, b []byte) (resp []byte, err error) {
+			start := time.Now()
+			resp, err = next(info, b)
+
+			typ := "statement"
+			if info.Request {
+				typ = "request"
+			}
+
+			if err != nil {
+				l.Printf("%s %x from %s failed after %v: %v", typ, info.ID[:], info.Key, time.Since(start), err)
+			} else {
+				l.Printf("%s %x from %s processed in %v", typ, info.ID[:], info.Key, time.Since(start))
+			}
+
+			return
+		}
+	}
+}
+
+// Latency returns Middleware which passes the processing time of each message to the provided func
+func Latency(fn func(info MsgInfo, d time.Duration)) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(info MsgInfo, b []byte) (resp []byte, err error) {
+			start := time.Now()
+			resp, err = next(info, b)
+			fn(info, time.Since(start))
+			return
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package mq
 
 import (
+	"crypto/hmac"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"net"
 
 	"github.com/missionMeteora/jump/chanchan"
 )
@@ -57,11 +61,145 @@ var (
 
 	// ErrEmptyToken is returned when an empty token is provided
 	ErrEmptyToken = errors.New("empty token provided")
+
+	// ErrInvalidCA is returned when a certificate authority file does not contain any valid certificates
+	ErrInvalidCA = errors.New("certificate authority file does not contain any valid certificates")
+
+	// ErrTLSRequired is returned when certificate authentication is enabled without a TLS configuration
+	ErrTLSRequired = errors.New("certificate authentication requires a TLS configuration")
+
+	// ErrRevoked is returned when a connection is closed because it's credentials have been revoked
+	ErrRevoked = errors.New("credentials have been revoked")
+
+	// ErrHeartbeat is returned when a connection is closed because the other side stopped responding to heartbeats
+	ErrHeartbeat = errors.New("connection closed after missed heartbeats")
+
+	// ErrMsgRejected is returned when the other side rejects a message (e.g. the body exceeds it's maximum body size)
+	ErrMsgRejected = errors.New("message was rejected by the other side")
+
+	// ErrInvalidMethod is returned when a method name is empty or longer than 255 bytes
+	ErrInvalidMethod = errors.New("method name must be between 1 and 255 bytes")
+
+	// ErrNoMethod is returned when a message does not contain a method name
+	ErrNoMethod = errors.New("message does not contain a method name")
+
+	// ErrUnknownMethod is sent to the requester when a Mux has no handler for the requested method
+	// Note: This is a ResponseError so that it can be compared against the error passed to the requester
+	ErrUnknownMethod = ResponseError("unknown method")
+
+	// ErrInvalidTopic is returned when a topic or topic pattern is invalid
+	ErrInvalidTopic = errors.New("invalid topic, topics are dot separated tokens of up to 255 bytes")
+
+	// ErrPubSubNotSupported is returned when subscribing to a server which does not support publish/subscribe
+	ErrPubSubNotSupported = errors.New("server does not support publish/subscribe")
+
+	// ErrRouteNotSupported is returned when sending to another client through a server which does not support
+	// or allow routing (see ServerOpts.Routing)
+	ErrRouteNotSupported = errors.New("server does not support routing between clients")
+
+	// ErrRouteForbidden is sent to the requester when a RouteAuthenticator does not allow reaching the target
+	// Note: This is a ResponseError so that it can be compared against the error passed to the requester
+	ErrRouteForbidden = ResponseError("not allowed to reach target")
+
+	// ErrTargetOffline is sent to the requester when the target of a forwarded message is not connected
+	// Note: This is a ResponseError so that it can be compared against the error passed to the requester
+	ErrTargetOffline = ResponseError("target is not connected")
+
+	// ErrConnLost is passed to the requester when the connection is lost after a request was sent
+	// Note: This is only used when pending requests are resumed after reconnecting, see RequestIdempotent
+	ErrConnLost = errors.New("connection was lost after the request was sent")
+
+	// ErrAckNotSupported is returned when sending an acknowledged statement to a peer which does not acknowledge statements
+	ErrAckNotSupported = errors.New("other side does not support acknowledged statements")
+
+	// ErrNotAcknowledged is sent to the error chan when an acknowledged statement is dropped after being sent again
+	// the maximum number of times (see ServerOpts.AckRetries and ClientOpts.AckRetries)
+	ErrNotAcknowledged = errors.New("acknowledged statement was not acknowledged")
+
+	// ErrGroupDoesNotExist is returned when a queue group does not exist, groups exist while they have members
+	ErrGroupDoesNotExist = errors.New("queue group does not exist")
+
+	// ErrNoGroupMembers is returned when none of the members of a queue group are connected
+	ErrNoGroupMembers = errors.New("no members of the queue group are connected")
+
+	// ErrInvalidService is returned when a registered service is unnamed or has no methods of the form Method(args, *reply) error
+	ErrInvalidService = errors.New("service must be named and have at least one method of the form Method(args, *reply) error")
+
+	// ErrNoDeadLetterSink is returned when inspecting or replaying dead letters without a dead-letter sink
+	ErrNoDeadLetterSink = errors.New("dead-letter sink has not been set")
+
+	// ErrDeadLetterDoesNotExist is returned when a dead letter does not exist within the dead-letter sink
+	ErrDeadLetterDoesNotExist = errors.New("dead letter does not exist")
+
+	// ErrDeadLetterInbound is returned when replaying a dead letter which was received rather than sent
+	ErrDeadLetterInbound = errors.New("inbound dead letters cannot be replayed")
 )
 
+// VersionError is returned when a client and server do not share a supported protocol version
+type VersionError struct {
+	// Protocol version which is not supported
+	Version uint8
+	// Range of supported protocol versions
+	Min uint8
+	Max uint8
+}
+
+// Error returns the error message
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol version %d is not supported, supported versions are %d through %d", e.Version, e.Min, e.Max)
+}
+
+// BodySizeError is sent to the error channel when an inbound message body exceeds the maximum body size
+// Note: The connection which sent the message is closed
+type BodySizeError struct {
+	// Key of the connection which sent the message
+	Key Chunk
+	// Size of the message body
+	Size int64
+	// Maximum body size
+	Max int64
+}
+
+// Error returns the error message
+func (e *BodySizeError) Error() string {
+	return fmt.Sprintf("message body of %d bytes from %s exceeds maximum body size of %d bytes", e.Size, e.Key, e.Max)
+}
+
+// SpoolFullError is returned when a statement for a key which is not connected would exceed the maximum spool size
+type SpoolFullError struct {
+	// Key the statement was addressed to
+	Key Chunk
+	// Size of the statements spooled for the key
+	Size int64
+	// Maximum spool size
+	Max int64
+}
+
+// Error returns the error message
+func (e *SpoolFullError) Error() string {
+	return fmt.Sprintf("spool for %s is full, %d of %d bytes used", e.Key, e.Size, e.Max)
+}
+
+// UndeliverableError is sent to a client's error chan when a statement it sent to another client could not be delivered
+type UndeliverableError struct {
+	// Key of the target client
+	Key Chunk
+	// Reason the statement was not delivered, ErrTargetOffline or ErrRouteForbidden
+	Err error
+}
+
+// Error returns the error message
+func (e *UndeliverableError) Error() string {
+	return fmt.Sprintf("statement to %s could not be delivered: %v", e.Key, e.Err)
+}
+
 // ReqFunc is used when receiving a response or a statement
 type ReqFunc func([]byte)
 
+// ReqErrFunc is used when receiving a response which may be an error. The error will be a
+// ResponseError when the responding Receiver failed, or ErrConnIsClosed when the connection closed first
+type ReqErrFunc func([]byte, error)
+
 // RespFunc is used when responding to a request
 type RespFunc func([]byte) []byte
 
@@ -102,6 +240,118 @@ func (r *Rec) Statement(b []byte) {
 	r.stmnt(b)
 }
 
+// ErrReceiver is used to respond to inbound messages when responses may fail
+type ErrReceiver interface {
+	// Inbound message expects a response, a non-nil error is sent to the requester in place of the response
+	Response([]byte) ([]byte, error)
+	// Inbound message is not expecting a response
+	Statement([]byte)
+}
+
+// NewErrRec returns a pointer to a new ErrRec
+func NewErrRec(res func([]byte) ([]byte, error), stmnt func([]byte)) *ErrRec {
+	return &ErrRec{res, stmnt}
+}
+
+// ErrRec is a public pre-defined ErrReceiver
+type ErrRec struct {
+	res   func([]byte) ([]byte, error)
+	stmnt func([]byte)
+}
+
+// Response is a func for responses
+func (r *ErrRec) Response(b []byte) ([]byte, error) {
+	if r.res == nil {
+		return nil, nil
+	}
+
+	return r.res(b)
+}
+
+// Statement is a func for statements
+func (r *ErrRec) Statement(b []byte) {
+	if r.stmnt == nil {
+		return
+	}
+
+	r.stmnt(b)
+}
+
+// errRec wraps a Receiver so that it can be used as an ErrReceiver
+type errRec struct {
+	Receiver
+}
+
+// Response will call the underlying Receiver's Response, it never returns an error
+func (r errRec) Response(b []byte) ([]byte, error) {
+	return r.Receiver.Response(b), nil
+}
+
+// KeyReceiver is used to respond to inbound messages when the key of the sending node is needed
+type KeyReceiver interface {
+	// Inbound message expects a response, a non-nil error is sent to the requester in place of the response
+	Response(key Chunk, b []byte) ([]byte, error)
+	// Inbound message is not expecting a response
+	Statement(key Chunk, b []byte)
+}
+
+// NewKeyRec returns a pointer to a new KeyRec
+func NewKeyRec(res func(Chunk, []byte) ([]byte, error), stmnt func(Chunk, []byte)) *KeyRec {
+	return &KeyRec{res, stmnt}
+}
+
+// KeyRec is a public pre-defined KeyReceiver
+type KeyRec struct {
+	res   func(Chunk, []byte) ([]byte, error)
+	stmnt func(Chunk, []byte)
+}
+
+// Response is a func for responses
+func (r *KeyRec) Response(key Chunk, b []byte) ([]byte, error) {
+	if r.res == nil {
+		return nil, nil
+	}
+
+	return r.res(key, b)
+}
+
+// Statement is a func for statements
+func (r *KeyRec) Statement(key Chunk, b []byte) {
+	if r.stmnt == nil {
+		return
+	}
+
+	r.stmnt(key, b)
+}
+
+// IgnoreKey returns a KeyReceiver which passes inbound messages to the provided Receiver, discarding the key
+func IgnoreKey(rec Receiver) KeyReceiver {
+	return keyRec{errRec{rec}}
+}
+
+// keyRec wraps an ErrReceiver so that it can be used as a KeyReceiver
+type keyRec struct {
+	rec ErrReceiver
+}
+
+// Response will call the underlying ErrReceiver's Response
+func (r keyRec) Response(_ Chunk, b []byte) ([]byte, error) {
+	return r.rec.Response(b)
+}
+
+// Statement will call the underlying ErrReceiver's Statement
+func (r keyRec) Statement(_ Chunk, b []byte) {
+	r.rec.Statement(b)
+}
+
+// ResponseError is passed to the requester when the responding ErrReceiver returns an error
+type ResponseError string
+
+// Error returns the error message provided by the responding ErrReceiver
+func (e ResponseError) Error() string {
+	return string(e)
+}
+
 // Operator is used in the creation of both Servers and Clients
 type Operator interface {
 	// Called when connection is opened. The ID of the connecting node will be passed
@@ -110,15 +360,29 @@ type Operator interface {
 	OnDisconnect(Chunk)
 }
 
+// ReasonOperator is an Operator which is notified of the reason a connection was closed
+type ReasonOperator interface {
+	Operator
+	// Called in place of OnDisconnect when connection is closed. The ID of the disconnected node will be passed
+	// along with the reason for the disconnect (nil when the connection was closed locally)
+	OnDisconnectReason(Chunk, error)
+}
+
 // NewOp returns a pointer to a new Op
 func NewOp(onC func(Chunk) error, onDC func(Chunk)) *Op {
-	return &Op{onC, onDC}
+	return &Op{onC: onC, onDC: onDC}
+}
+
+// NewReasonOp returns a pointer to a new Op which is notified of the reason for disconnects
+func NewReasonOp(onC func(Chunk) error, onDC func(Chunk, error)) *Op {
+	return &Op{onC: onC, onDCR: onDC}
 }
 
-// Op is a public pre-defined Operator
+// Op is a public pre-defined ReasonOperator
 type Op struct {
-	onC  func(Chunk) error
-	onDC func(Chunk)
+	onC   func(Chunk) error
+	onDC  func(Chunk)
+	onDCR func(Chunk, error)
 }
 
 // OnConnect will call onC when a node disconnects
@@ -141,10 +405,103 @@ func (o *Op) OnDisconnect(c Chunk) {
 	o.onDC(c)
 }
 
-// handshake is used to determine if a connecting client is a match for the server's auth list
-type handshake struct {
-	key   Chunk
-	token Chunk
+// OnDisconnectReason will call onDCR when a node disconnects. If onDCR does not exist, OnDisconnect is called
+func (o *Op) OnDisconnectReason(c Chunk, reason error) {
+	if o.onDCR == nil {
+		// onDCR does not exist, fall back to OnDisconnect
+		o.OnDisconnect(c)
+		return
+	}
+
+	o.onDCR(c, reason)
+}
+
+// notifyDisconnect will notify an Operator of a disconnect, the reason is passed when the Operator supports it
+func notifyDisconnect(op Operator, c Chunk, reason error) {
+	if rop, ok := op.(ReasonOperator); ok {
+		rop.OnDisconnectReason(c, reason)
+		return
+	}
+
+	op.OnDisconnect(c)
+}
+
+// Authenticator is used to authenticate connecting clients
+// Note: Keys revoked by Server.Revoke are rejected before the Authenticator is called
+type Authenticator interface {
+	// Called with the handshake of a connecting client. When ok is true, the client is allowed
+	// to connect and meta is held by the connection (see Server.Meta) until it's closed
+	Authenticate(Handshake) (meta interface{}, ok bool)
+}
+
+// NewAuthFunc returns a pointer to a new AuthFunc
+func NewAuthFunc(fn func(Handshake) (interface{}, bool)) *AuthFunc {
+	return &AuthFunc{fn}
+}
+
+// AuthFunc is a public pre-defined Authenticator
+type AuthFunc struct {
+	fn func(Handshake) (interface{}, bool)
+}
+
+// Authenticate will call fn for the provided handshake
+func (a *AuthFunc) Authenticate(h Handshake) (meta interface{}, ok bool) {
+	if a.fn == nil {
+		// fn does not exist, deny by default
+		return
+	}
+
+	return a.fn(h)
+}
+
+// RouteAuthenticator is an Authenticator which also decides whether clients may send messages to each other
+// Note: When routing is enabled and the Authenticator does not implement RouteAuthenticator, every route is allowed
+type RouteAuthenticator interface {
+	Authenticator
+	// Called for each message a client sends to another client, the message is rejected when ok is false
+	AuthorizeRoute(from, to Chunk) (ok bool)
+}
+
+// KeyAuthenticator is an Authenticator which also reports which keys may connect
+// Note: Statements to known keys which are not connected are spooled (see ServerOpts.SpoolPath). When the
+// Authenticator does not implement KeyAuthenticator, only keys with a token (see Server.PutAuth) are known
+type KeyAuthenticator interface {
+	Authenticator
+	// Called for statements to keys which have not connected, ok is true when the key may connect
+	KnownKey(key Chunk) (ok bool)
+}
+
+// Handshake is used to determine if a connecting client is allowed to access a server
+type Handshake struct {
+	// Key provided by the client. When Verified is true, this is the key represented by the client's certificate
+	Key Chunk
+	// Token provided by the client, empty when Challenge is true
+	Token Chunk
+	// Remote address of the connecting client
+	Addr net.Addr
+	// Protocol version negotiated with the client, one represents a legacy client
+	Version uint8
+	// Capabilities negotiated with the client
+	caps uint32
+
+	// Challenge is true when the client proved knowledge of it's token with a challenge-response handshake
+	Challenge bool
+	// Nonce sent to the client and the HMAC it responded with, only set when Challenge is true
+	Nonce []byte
+	MAC   []byte
+
+	// Verified is true when Key was provided by a verified client certificate
+	Verified bool
+}
+
+// VerifyToken returns whether or not the handshake proves knowledge of the provided token
+// Note: This works for both raw token and challenge-response handshakes
+func (h *Handshake) VerifyToken(token Chunk) bool {
+	if h.Challenge {
+		return hmac.Equal(h.MAC, challengeMAC(h.Key, token, h.Nonce))
+	}
+
+	return subtle.ConstantTimeCompare(h.Token[:], token[:]) == 1
 }
 
 // NewChunk returns a new chunk using the provided byteslice
@@ -1,10 +1,26 @@
 package mq
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/missionMeteora/jump/chanchan"
+	"github.com/missionMeteora/jump/uuid"
 )
 
 const (
@@ -13,6 +29,42 @@ const (
 
 	mainPort = ":1337"
 	altPort  = ":1338"
+	chlgPort = ":1339"
+	authPort = ":1340"
+	rvkPort  = ":1341"
+	hbPort   = ":1342"
+	maxPort  = ":1343"
+	lgcyPort = ":1344"
+	verPort  = ":1345"
+	hsPort   = ":1346"
+	srvPort  = ":1347"
+	anyPort  = ":1348"
+	wrkPort  = ":1349"
+	mwPort   = ":1350"
+	callPort = ":1351"
+	svcPort  = ":1352"
+	subPort  = ":1353"
+	rtePort  = ":1354"
+	grpPort  = ":1355"
+	splPort  = ":1356"
+	ackPort  = ":1357"
+	rsmPort  = ":1358"
+	dlPort   = ":1359"
+	tlsPort  = ":1360"
+	certPort = ":1361"
+	rvkaPort = ":1362"
+	grpcPort = ":1363"
+	rsqPort  = ":1364"
+	prxPort  = ":1365"
+	cdlPort  = ":1366"
+	drnPort  = ":1367"
+	dprPort  = ":1368"
+	cbkPort  = ":1369"
+	hbbPort  = ":1370"
+	hbpPort  = ":1371"
+	ivlPort  = ":1372"
+	arPort   = ":1373"
+	skPort   = ":1374"
 	srvName  = "HonestHyena"
 )
 
@@ -200,20 +252,2925 @@ func TestClientReconnect(t *testing.T) {
 	time.Sleep(time.Second * 1)
 }
 
-func BenchmarkStatement(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		s.Statement(clntName, stmnt)
+func TestClientCloseDuringBackoff(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 2)
+	disconnected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, func(ch Chunk) {
+		disconnected <- struct{}{}
+	})
+
+	newServer := func() (s *Server, err error) {
+		if s, err = NewServer(ServerOpts{
+			Name: srvName,
+			Loc:  cbkPort,
+		}); err != nil {
+			return
+		}
+
+		s.PutAuth(clntName, clntTkn)
+		return
 	}
 
-	b.ReportAllocs()
+	if s, err = newServer(); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   cbkPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	s.Close()
+	<-disconnected
+
+	// Our client is waiting to redial, close it before the server comes back
+	c.Close()
+	if s, err = newServer(); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	// Wait past the first dialback
+	time.Sleep(time.Second * 6)
+	select {
+	case <-connected:
+		t.Error("Closed client reconnected")
+	default:
+	}
+
+	if cc, ok := s.c.Get(clntChunk); ok && cc.isConnected() {
+		t.Error("Closed client is listed as connected")
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
 }
 
-func BenchmarkRequest(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		s.Request(clntName, req, func(b []byte) {
-			respVal = b
-		})
+func TestChallenge(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:             srvName,
+		Loc:              chlgPort,
+		RequireChallenge: true,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
 	}
 
-	b.ReportAllocs()
+	s.PutAuth(clntName, clntTkn)
+
+	if c, err = NewClient(ClientOpts{
+		Name:      clntName,
+		Token:     clntTkn,
+		Op:        op,
+		Loc:       chlgPort,
+		Challenge: true,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	c.Close()
+
+	var nc net.Conn
+	if nc, err = net.Dial("tcp", chlgPort); err != nil {
+		t.Error("Error dialing server", err)
+		return
+	}
+
+	// Raw tokens are not accepted when challenge-response is required
+	if _, _, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoV1); err != ErrForbidden {
+		t.Errorf("Invalid error, expected %v and received %v", ErrForbidden, err)
+	}
+
+	nc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestAuthenticator(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	auth := NewAuthFunc(func(hs Handshake) (meta interface{}, ok bool) {
+		if hs.Key != clntChunk || !hs.VerifyToken(clntTknChunk) {
+			return
+		}
+
+		return hs.Key.String() + " meta", true
+	})
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  authPort,
+		Auth: auth,
+		Op:   op,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:      clntName,
+		Token:     clntTkn,
+		Loc:       authPort,
+		Challenge: true,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+
+	if meta, ok := s.Meta(clntName); !ok || meta != clntName+" meta" {
+		t.Errorf("Invalid meta, expected \"%s meta\" and received \"%v\"", clntName, meta)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestRevoke(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	disconnected := make(chan error, 1)
+	op := NewReasonOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, func(ch Chunk, reason error) {
+		disconnected <- reason
+	})
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  rvkPort,
+		Op:   op,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Loc:   rvkPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+
+	if err = s.Revoke(clntName); err != nil {
+		t.Error("Error revoking client", err)
+	}
+
+	if reason := <-disconnected; reason != ErrRevoked {
+		t.Errorf("Invalid reason, expected %v and received %v", ErrRevoked, reason)
+	}
+
+	if _, ok := s.GetAuth(clntName); ok {
+		t.Error("Auth exists after being revoked")
+	}
+
+	if v, err := c.ErrC().Receive(true); err != nil || v != ErrRevoked {
+		t.Errorf("Invalid client error, expected %v and received %v", ErrRevoked, v)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	ca := newTestCert(t, "mq-test-ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  tlsPort,
+		TLS:  &tls.Config{Certificates: []tls.Certificate{newTestCert(t, "localhost", &ca)}},
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   tlsPort,
+		TLS:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	if err = s.Statement(clntName, stmnt); err != nil {
+		t.Error("Error sending statement", err)
+	}
+
+	c.Receive(NewRec(nil, func(b []byte) {
+		if str := string(b); str != string(stmnt) {
+			t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", stmnt, str)
+		}
+	}))
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestCertAuth(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	ca := newTestCert(t, "mq-test-ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:     srvName,
+		Loc:      certPort,
+		CertAuth: true,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{newTestCert(t, "localhost", &ca)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	// Our client has no token, it is authenticated by it's certificate
+	if c, err = NewClient(ClientOpts{
+		Name: clntName,
+		Op:   op,
+		Loc:  certPort,
+		TLS: &tls.Config{
+			RootCAs:      pool,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{newTestCert(t, clntName, &ca)},
+		},
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	if !s.IsConnected(clntName) {
+		t.Error("Client is not connected")
+	}
+
+	c.Close()
+
+	// Certificates which are missing, not signed by our CA or have a common name longer than a key are rejected
+	rejected := []struct {
+		name  string
+		certs []tls.Certificate
+	}{
+		{"missing", nil},
+		{"unverified", []tls.Certificate{newTestCert(t, clntName, nil)}},
+		{"oversized common name", []tls.Certificate{newTestCert(t, clntName+"WithALongerName", &ca)}},
+	}
+
+	for _, r := range rejected {
+		var nc net.Conn
+		if nc, err = tls.Dial("tcp", certPort, &tls.Config{
+			RootCAs:      pool,
+			ServerName:   "localhost",
+			Certificates: r.certs,
+		}); err != nil {
+			t.Errorf("Error dialing server with %s certificate: %v", r.name, err)
+			continue
+		}
+
+		if _, _, err = clientHandshake(nc, Chunk{}, Chunk{}, false, protoCurrent); err == nil {
+			t.Errorf("Client with %s certificate was not rejected", r.name)
+		}
+
+		nc.Close()
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+// newTestCert returns a certificate for the provided common name, signed by parent. The
+// certificate is a self-signed certificate authority when parent is nil
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) (cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey); err != nil {
+		t.Fatal("Error creating certificate", err)
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal("Error parsing certificate", err)
+	}
+
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	return
+}
+
+func TestRevokeAuthenticator(t *testing.T) {
+	var (
+		s   *Server
+		nc  net.Conn
+		err error
+	)
+
+	auth := NewAuthFunc(func(hs Handshake) (meta interface{}, ok bool) {
+		return nil, hs.Key == clntChunk && hs.VerifyToken(clntTknChunk)
+	})
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  rvkaPort,
+		Auth: auth,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	// handshake will connect to our server and return the handshake error
+	handshake := func() error {
+		if nc, err = net.Dial("tcp", rvkaPort); err != nil {
+			return err
+		}
+
+		defer nc.Close()
+		_, _, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoCurrent)
+		return err
+	}
+
+	if err = handshake(); err != nil {
+		t.Error("Error completing handshake", err)
+	}
+
+	if err = s.Revoke(clntName); err != nil {
+		t.Error("Error revoking client", err)
+	}
+
+	// Our Authenticator would accept the client, the revoked key must be rejected before it's called
+	if err = handshake(); err != ErrForbidden {
+		t.Errorf("Invalid error, expected %v and received %v", ErrForbidden, err)
+	}
+
+	if err = s.Restore(clntName); err != nil {
+		t.Error("Error restoring client", err)
+	}
+
+	if err = handshake(); err != nil {
+		t.Error("Error completing handshake after restoring", err)
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestRequestCtx(t *testing.T) {
+	var (
+		resp []byte
+		err  error
+	)
+
+	if resp, err = s.RequestCtx(context.Background(), clntName, req); err != nil {
+		t.Error("Error requesting", err)
+	} else if str := string(resp); str != "ok" {
+		t.Errorf("Incorrect response, expected \"ok\" and we received \"%s\"", str)
+	}
+
+	// pending returns the number of response funcs waiting on our client
+	pending := func() (n int) {
+		c.rw.mux.RLock()
+		n = len(c.rw.m)
+		c.rw.mux.RUnlock()
+		return
+	}
+
+	// Nothing is receiving on the server side, so our request will time out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	waiting := pending()
+	if _, err = c.RequestCtx(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	// The response func of the timed out request should not be left behind
+	if n := pending(); n != waiting {
+		t.Errorf("Invalid number of waiting response funcs, expected %d and received %d", waiting, n)
+	}
+
+	// Drain the timed out request so it is not picked up by other tests, the late response should not find
+	// a response func to call
+	s.Receive(clntName, &ti)
+	for i := 0; ; i++ {
+		if v, err := c.ErrC().Receive(false); err == nil && v == ErrReqFnDoesNotExist {
+			break
+		} else if i == 100 {
+			t.Errorf("Invalid error, expected %v for the late response", ErrReqFnDoesNotExist)
+			break
+		} else if err != nil {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	var (
+		resp []byte
+		err  error
+		fail = ResponseError("nope")
+	)
+
+	go s.ReceiveErr(clntName, NewErrRec(func(b []byte) ([]byte, error) {
+		return nil, fail
+	}, nil))
+
+	if resp, err = c.RequestCtx(context.Background(), req); err != fail {
+		t.Errorf("Invalid error, expected %v and received %v", fail, err)
+	} else if resp != nil {
+		t.Errorf("Invalid response, expected nil and received \"%s\"", resp)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var (
+		s   *Server
+		nc  net.Conn
+		err error
+	)
+
+	disconnected := make(chan error, 1)
+	op := NewReasonOp(nil, func(ch Chunk, reason error) {
+		disconnected <- reason
+	})
+
+	if s, err = NewServer(ServerOpts{
+		Name:            srvName,
+		Loc:             hbPort,
+		Heartbeat:       time.Millisecond * 50,
+		HeartbeatMisses: 2,
+		Op:              op,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if nc, err = net.Dial("tcp", hbPort); err != nil {
+		t.Error("Error dialing server", err)
+		return
+	}
+
+	// Our raw connection will never answer pings
+	if _, _, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoCurrent); err != nil {
+		t.Error("Error performing handshake", err)
+		return
+	}
+
+	select {
+	case reason := <-disconnected:
+		if reason != ErrHeartbeat {
+			t.Errorf("Invalid reason, expected %v and received %v", ErrHeartbeat, reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("Connection was not closed after missed heartbeats")
+	}
+
+	nc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:        srvName,
+		Loc:         maxPort,
+		MaxBodySize: 8,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   maxPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	c.Statement(stmnt)
+
+	v, _ := s.ErrC().Receive(true)
+	if bse, ok := v.(*BodySizeError); !ok {
+		t.Errorf("Invalid error, expected *BodySizeError and received %v", v)
+	} else if bse.Key != clntChunk || bse.Size != int64(len(stmnt)) {
+		t.Errorf("Invalid error values, received %v", bse)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestNegativeBodyLength(t *testing.T) {
+	var (
+		s   *Server
+		nc  net.Conn
+		p   proto
+		m   msg
+		err error
+	)
+
+	// invalidHeader returns a message header with the top bit of the body length set
+	invalidHeader := func(ver uint8) (buf []byte) {
+		buf = make([]byte, HeaderLen)
+		id := uuid.New()
+		copy(buf[:16], id[:])
+		byteOrder(ver).PutUint64(buf[16:24], 1<<63|8)
+		buf[24] = byte(mtStatement)
+		buf[25] = byte(statusOK)
+		return
+	}
+
+	// Handshake messages with a negative length are rejected
+	pr, pw := net.Pipe()
+	go pw.Write(invalidHeader(protoCurrent))
+	if _, err = readMsg(pr, protoCurrent); err != ErrInvalidMsgLength {
+		t.Errorf("Invalid error, expected %v and received %v", ErrInvalidMsgLength, err)
+	}
+
+	pr.Close()
+	pw.Close()
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  ivlPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if nc, err = net.Dial("tcp", ivlPort); err != nil {
+		t.Error("Error dialing", err)
+		return
+	}
+
+	if _, p, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoCurrent); err != nil {
+		t.Error("Error performing handshake", err)
+		return
+	}
+
+	if _, err = nc.Write(invalidHeader(p.ver)); err != nil {
+		t.Error("Error writing header", err)
+	}
+
+	// Server rejects the message and closes the conn rather than reading out of sync
+	nc.SetDeadline(time.Now().Add(time.Second * 5))
+	if m, err = readMsg(nc, p.ver); err != nil {
+		t.Error("Error reading message", err)
+	} else if m.s != statusInvalid {
+		t.Errorf("Invalid status, expected %v and received %v", statusInvalid, m.s)
+	}
+
+	if _, err = readMsg(nc, p.ver); err != io.EOF {
+		t.Errorf("Invalid error, expected %v and received %v", io.EOF, err)
+	}
+
+	if v, _ := s.ErrC().Receive(true); v != ErrInvalidMsgLength {
+		t.Errorf("Invalid error, expected %v and received %v", ErrInvalidMsgLength, v)
+	}
+
+	nc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+
+		msg  = "Hai!"
+		msgB = []byte(msg)
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  lgcyPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if c, err = NewClient(ClientOpts{
+		Name:           clntName,
+		Token:          clntTkn,
+		Op:             op,
+		Loc:            lgcyPort,
+		LegacyProtocol: true,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+
+	if c.ver != protoV1 {
+		t.Errorf("Invalid protocol version, expected %d and received %d", protoV1, c.ver)
+	}
+
+	s.Statement(clntName, msgB)
+	c.Receive(NewRec(nil, func(b []byte) {
+		if str := string(b); str != msg {
+			t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", msg, str)
+		}
+	}))
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestMinProtocolVersion(t *testing.T) {
+	var (
+		s   *Server
+		nc  net.Conn
+		p   proto
+		err error
+	)
+
+	if s, err = NewServer(ServerOpts{
+		Name:               srvName,
+		Loc:                verPort,
+		MinProtocolVersion: protoV2,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	if nc, err = net.Dial("tcp", verPort); err != nil {
+		t.Error("Error dialing server", err)
+		return
+	}
+
+	// Legacy clients are rejected with the range of supported versions
+	_, _, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoV1)
+	if verr, ok := err.(*VersionError); !ok {
+		t.Errorf("Invalid error, expected *VersionError and received %v", err)
+	} else if verr.Min != protoV2 || verr.Max != protoCurrent {
+		t.Errorf("Invalid version range, received %d through %d", verr.Min, verr.Max)
+	}
+
+	nc.Close()
+
+	if nc, err = net.Dial("tcp", verPort); err != nil {
+		t.Error("Error dialing server", err)
+		return
+	}
+
+	// Clients newer than the server are downgraded
+	// Note: Routing is disabled, so it's capability is not negotiated
+	caps := uint32(capAll &^ capRoute)
+	if _, p, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoCurrent+1); err != nil {
+		t.Error("Error performing handshake", err)
+	} else if p.ver != protoCurrent || p.caps != caps {
+		t.Errorf("Invalid protocol, expected %d (%d) and received %d (%d)", protoCurrent, caps, p.ver, p.caps)
+	}
+
+	nc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		nc  net.Conn
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:             srvName,
+		Loc:              hsPort,
+		HandshakeTimeout: time.Millisecond * 100,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Our raw connection will never send it's handshake
+	if nc, err = net.Dial("tcp", hsPort); err != nil {
+		t.Error("Error dialing server", err)
+		return
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   hsPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(time.Millisecond * 50):
+		t.Error("Client was blocked by a pending handshake")
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	if hs := s.HandshakeStats(); hs.TimedOut != 1 || hs.Accepted != 1 || hs.Pending != 0 {
+		t.Errorf("Invalid handshake stats, received %+v", hs)
+	}
+
+	nc.Close()
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestServe(t *testing.T) {
+	var (
+		s    *Server
+		c    *Client
+		resp []byte
+		err  error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  srvPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	served := make(chan error, 1)
+	go func() {
+		// Respond with the key of the requesting client
+		served <- s.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+			return []byte(key.String()), nil
+		}, nil))
+	}()
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   srvPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	for i := 0; i < 3; i++ {
+		if resp, err = c.RequestCtx(context.Background(), req); err != nil {
+			t.Error("Error requesting", err)
+		} else if string(resp) != clntName {
+			t.Errorf("Invalid response, expected %s and received \"%s\"", clntName, resp)
+		}
+	}
+
+	c.Close()
+	s.Close()
+
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Error("Error serving", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return after the server was closed")
+	}
+
+	time.Sleep(time.Second * 1)
+}
+
+func TestReceiveAny(t *testing.T) {
+	var (
+		s   *Server
+		err error
+	)
+
+	connected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  anyPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	names := []string{clntName, "CuriousCoyote"}
+	clients := make([]*Client, 0, len(names))
+	for _, name := range names {
+		s.PutAuth(name, clntTkn)
+
+		var c *Client
+		if c, err = NewClient(ClientOpts{
+			Name:  name,
+			Token: clntTkn,
+			Op:    op,
+			Loc:   anyPort,
+		}); err != nil {
+			t.Error("Error getting new client", err)
+			return
+		}
+
+		clients = append(clients, c)
+		<-connected
+	}
+
+	// Respond to requests from any client with the key of the requesting client
+	rec := NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		return []byte(key.String()), nil
+	}, nil)
+
+	go func() {
+		for s.ReceiveAny(rec) == nil {
+		}
+	}()
+
+	for i, c := range clients {
+		if resp, err := c.RequestCtx(context.Background(), req); err != nil {
+			t.Error("Error requesting", err)
+		} else if string(resp) != names[i] {
+			t.Errorf("Invalid response, expected %s and received \"%s\"", names[i], resp)
+		}
+
+		c.Close()
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestWorkers(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:    srvName,
+		Loc:     wrkPort,
+		Workers: 4,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Slow responses should not hold up one another
+	go s.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		time.Sleep(time.Millisecond * 200)
+		return b, nil
+	}, nil))
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   wrkPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	start := time.Now()
+	done := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		c.RequestErr(req, func(b []byte, err error) {
+			done <- err
+		})
+	}
+
+	for i := 0; i < 4; i++ {
+		if err = <-done; err != nil {
+			t.Error("Error requesting", err)
+		}
+	}
+
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Errorf("Requests were not processed concurrently, took %v", d)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestMux(t *testing.T) {
+	var (
+		b    []byte
+		resp []byte
+		err  error
+	)
+
+	mux := NewMux()
+	mux.HandleFunc("echo", func(key Chunk, b []byte) ([]byte, error) {
+		return b, nil
+	}, nil)
+
+	b, _ = NewMethodMsg("echo", req)
+	if resp, err = mux.Response(clntChunk, b); err != nil {
+		t.Error("Error routing request", err)
+	} else if string(resp) != string(req) {
+		t.Errorf("Invalid response, expected \"%s\" and received \"%s\"", req, resp)
+	}
+
+	b, _ = NewMethodMsg("missing", req)
+	if _, err = mux.Response(clntChunk, b); err != ErrUnknownMethod {
+		t.Errorf("Invalid error, expected %v and received %v", ErrUnknownMethod, err)
+	}
+
+	// Fallback is passed the entire message
+	mux.Fallback(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		return b, nil
+	}, nil))
+
+	if resp, err = mux.Response(clntChunk, b); err != nil {
+		t.Error("Error routing request to fallback", err)
+	} else if string(resp) != string(b) {
+		t.Errorf("Invalid response, expected \"%s\" and received \"%s\"", b, resp)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	measured := make(chan MsgInfo, 1)
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  mwPort,
+		Middleware: []Middleware{
+			Latency(func(info MsgInfo, d time.Duration) {
+				measured <- info
+			}),
+			Recover(),
+		},
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	go s.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		panic("oh no")
+	}, nil))
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   mwPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	expected := (&PanicError{Value: "oh no"}).Error()
+	if _, err = c.RequestCtx(context.Background(), req); err == nil || err.Error() != expected {
+		t.Errorf("Invalid error, expected %s and received %v", expected, err)
+	}
+
+	if info := <-measured; info.Key != clntChunk || !info.Request {
+		t.Errorf("Invalid message info, received %+v", info)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+type sumReq struct {
+	A, B int
+}
+
+type sumResp struct {
+	Sum int
+}
+
+func TestCall(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  callPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	mux := NewMux()
+	Handle(mux, "sum", func(key Chunk, req sumReq) (sumResp, error) {
+		return sumResp{Sum: req.A + req.B}, nil
+	})
+
+	gobSum := NewEndpoint[sumReq, sumResp]("gobSum", GobCodec)
+	gobSum.Handle(mux, func(key Chunk, req sumReq) (sumResp, error) {
+		return sumResp{Sum: req.A + req.B}, nil
+	})
+
+	go s.Serve(mux)
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   callPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	var resp sumResp
+	if resp, err = Call[sumReq, sumResp](context.Background(), c, "sum", sumReq{A: 1, B: 2}); err != nil {
+		t.Error("Error calling", err)
+	} else if resp.Sum != 3 {
+		t.Errorf("Invalid sum, expected 3 and received %d", resp.Sum)
+	}
+
+	if resp, err = gobSum.Call(context.Background(), c, sumReq{A: 3, B: 4}); err != nil {
+		t.Error("Error calling", err)
+	} else if resp.Sum != 7 {
+		t.Errorf("Invalid sum, expected 7 and received %d", resp.Sum)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+type Arith struct{}
+
+func (a *Arith) Sum(args sumReq, reply *sumResp) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
+
+func (a *Arith) Div(args sumReq, reply *sumResp) error {
+	if args.B == 0 {
+		return ResponseError("divide by zero")
+	}
+
+	reply.Sum = args.A / args.B
+	return nil
+}
+
+type Calc struct{}
+
+func (c *Calc) Add(args sumReq, reply *sumResp) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
+
+func (c *Calc) Multiply(args sumReq, reply *sumResp) error {
+	reply.Sum = args.A * args.B
+	return nil
+}
+
+func TestService(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  svcPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	mux := NewMux()
+	if err = mux.Register(&Arith{}); err != nil {
+		t.Error("Error registering service", err)
+		return
+	}
+
+	if err = mux.RegisterName("GobArith", &Arith{}, GobCodec); err != nil {
+		t.Error("Error registering service", err)
+		return
+	}
+
+	var nilArith *Arith
+	if err = mux.Register(nilArith); err != ErrInvalidService {
+		t.Errorf("Invalid error, expected %v and received %v", ErrInvalidService, err)
+	}
+
+	if err = mux.Register(nil); err != ErrInvalidService {
+		t.Errorf("Invalid error, expected %v and received %v", ErrInvalidService, err)
+	}
+
+	// Calc.Add fits within the method name limit while Calc.Multiply does not, neither should be registered
+	if err = mux.RegisterName(strings.Repeat("c", 250), &Calc{}, nil); err != ErrInvalidMethod {
+		t.Errorf("Invalid error, expected %v and received %v", ErrInvalidMethod, err)
+	}
+
+	go s.Serve(mux)
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   svcPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	var reply sumResp
+	if err = CallMethod(context.Background(), c, "Arith.Sum", sumReq{A: 1, B: 2}, &reply, nil); err != nil {
+		t.Error("Error calling method", err)
+	} else if reply.Sum != 3 {
+		t.Errorf("Invalid sum, expected 3 and received %d", reply.Sum)
+	}
+
+	if err = CallMethod(context.Background(), c, "GobArith.Sum", sumReq{A: 2, B: 3}, &reply, GobCodec); err != nil {
+		t.Error("Error calling method", err)
+	} else if reply.Sum != 5 {
+		t.Errorf("Invalid sum, expected 5 and received %d", reply.Sum)
+	}
+
+	if err = CallMethod(context.Background(), c, "Arith.Div", sumReq{A: 1}, &reply, nil); err != ResponseError("divide by zero") {
+		t.Errorf("Invalid error, expected divide by zero and received %v", err)
+	}
+
+	var l []string
+	if l, err = ListMethods(context.Background(), c); err != nil {
+		t.Error("Error listing methods", err)
+	} else if len(l) != 5 || l[0] != "Arith.Div" || l[1] != "Arith.Sum" || l[2] != "GobArith.Div" ||
+		l[3] != "GobArith.Sum" || l[4] != MethodsMethod {
+		t.Errorf("Invalid methods, received %v", l)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestPubSub(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	newServer := func() (s *Server, err error) {
+		if s, err = NewServer(ServerOpts{
+			Name: srvName,
+			Loc:  subPort,
+		}); err != nil {
+			return
+		}
+
+		s.PutAuth(clntName, clntTkn)
+		return
+	}
+
+	if s, err = newServer(); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   subPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	published := make(chan string, 4)
+	c.Subscribe("news.*", func(topic string, b []byte) {
+		published <- topic + ":" + string(b)
+	})
+
+	// Give our subscription time to reach the server
+	time.Sleep(time.Millisecond * 100)
+	s.Publish("weather.today", stmnt)
+	s.Publish("news.today", stmnt)
+
+	if p := <-published; p != "news.today:"+string(stmnt) {
+		t.Errorf("Invalid published message, received \"%s\"", p)
+	}
+
+	// Subscriptions should be restored once the client reconnects
+	s.Close()
+	if s, err = newServer(); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	<-connected
+	time.Sleep(time.Millisecond * 100)
+	s.Publish("news.tomorrow", stmnt)
+
+	select {
+	case p := <-published:
+		if p != "news.tomorrow:"+string(stmnt) {
+			t.Errorf("Invalid published message, received \"%s\"", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("Subscription was not restored after reconnecting")
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"news.today", "news.today", true},
+		{"news.*", "news.today", true},
+		{"news.*", "news.today.sports", false},
+		{"news.>", "news.today.sports", true},
+		{"news.>", "news", false},
+		{"*.today", "weather.today", true},
+	}
+
+	for _, tt := range tests {
+		if match := matchTopic(tt.pattern, tt.topic); match != tt.match {
+			t.Errorf("Invalid match for %s and %s, expected %v", tt.pattern, tt.topic, tt.match)
+		}
+	}
+}
+
+// routeAuth is a RouteAuthenticator which allows every client with our token and forbids routes to secret
+type routeAuth struct {
+	secret Chunk
+}
+
+func (r *routeAuth) Authenticate(hs Handshake) (meta interface{}, ok bool) {
+	return nil, hs.VerifyToken(clntTknChunk)
+}
+
+func (r *routeAuth) AuthorizeRoute(from, to Chunk) bool {
+	return to != r.secret
+}
+
+func TestRoute(t *testing.T) {
+	var (
+		s    *Server
+		resp []byte
+		err  error
+	)
+
+	// Routing is disabled by default
+	if err = c.StatementTo(clntName, stmnt); err != ErrRouteNotSupported {
+		t.Errorf("Invalid error, expected %v and received %v", ErrRouteNotSupported, err)
+	}
+
+	connected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	secret, _ := NewChunkFromString("SecretSquirrel")
+	if s, err = NewServer(ServerOpts{
+		Name:    srvName,
+		Loc:     rtePort,
+		Routing: true,
+		Auth:    &routeAuth{secret: secret},
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	names := []string{clntName, "CuriousCoyote"}
+	clients := make([]*Client, 0, len(names))
+	for _, name := range names {
+		s.PutAuth(name, clntTkn)
+
+		var c *Client
+		if c, err = NewClient(ClientOpts{
+			Name:  name,
+			Token: clntTkn,
+			Op:    op,
+			Loc:   rtePort,
+		}); err != nil {
+			t.Error("Error getting new client", err)
+			return
+		}
+
+		clients = append(clients, c)
+		<-connected
+	}
+
+	// Respond with the key of the requesting client
+	go clients[1].Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		return []byte(key.String()), nil
+	}, nil))
+
+	if resp, err = clients[0].RequestToCtx(context.Background(), names[1], req); err != nil {
+		t.Error("Error requesting", err)
+	} else if string(resp) != clntName {
+		t.Errorf("Invalid response, expected %s and received \"%s\"", clntName, resp)
+	}
+
+	if _, err = clients[0].RequestToCtx(context.Background(), "NobodyNoWhere", req); err != ErrTargetOffline {
+		t.Errorf("Invalid error, expected %v and received %v", ErrTargetOffline, err)
+	}
+
+	if _, err = clients[0].RequestToCtx(context.Background(), secret.String(), req); err != ErrRouteForbidden {
+		t.Errorf("Invalid error, expected %v and received %v", ErrRouteForbidden, err)
+	}
+
+	// Statements which cannot be delivered are returned to the sending client
+	if err = clients[0].StatementTo("NobodyNoWhere", stmnt); err != nil {
+		t.Error("Error sending statement", err)
+	}
+
+	if v, err := clients[0].ErrC().Receive(true); err != nil {
+		t.Error("Error receiving error", err)
+	} else if ue, ok := v.(*UndeliverableError); !ok || ue.Key.String() != "NobodyNoWhere" || ue.Err != ErrTargetOffline {
+		t.Errorf("Invalid error, expected *UndeliverableError for NobodyNoWhere and received %v", v)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestQueueGroup(t *testing.T) {
+	var (
+		s    *Server
+		resp []byte
+		err  error
+	)
+
+	connected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  grpPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	names := []string{clntName, "CuriousCoyote"}
+	for _, name := range names {
+		s.PutAuth(name, clntTkn)
+		s.JoinGroup("workers", name)
+	}
+
+	newClient := func(name string) (c *Client, err error) {
+		if c, err = NewClient(ClientOpts{
+			Name:  name,
+			Token: clntTkn,
+			Op:    op,
+			Loc:   grpPort,
+		}); err != nil {
+			return
+		}
+
+		<-connected
+		return
+	}
+
+	var first, second *Client
+	if first, err = newClient(names[0]); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	// Our first member never responds
+	received := make(chan struct{}, 1)
+	go first.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		received <- struct{}{}
+		time.Sleep(time.Second * 5)
+		return []byte(names[0]), nil
+	}, nil))
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+
+	rc := make(chan result, 1)
+	go func() {
+		resp, err := s.RequestGroupCtx(context.Background(), "workers", req)
+		rc <- result{resp, err}
+	}()
+
+	<-received
+	if second, err = newClient(names[1]); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	go second.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		return []byte(names[1]), nil
+	}, nil))
+
+	// Request should be retried with our second member once the first disconnects
+	first.Close()
+
+	select {
+	case r := <-rc:
+		if resp, err = r.resp, r.err; err != nil {
+			t.Error("Error requesting group", err)
+		} else if string(resp) != names[1] {
+			t.Errorf("Invalid response, expected %s and received \"%s\"", names[1], resp)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("Request was not retried after the member disconnected")
+	}
+
+	second.Close()
+	if _, err = s.RequestGroupCtx(context.Background(), "workers", req); err != ErrNoGroupMembers {
+		t.Errorf("Invalid error, expected %v and received %v", ErrNoGroupMembers, err)
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestQueueGroupCancel(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  grpcPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+	s.JoinGroup("workers", clntName)
+	// Member which never connects, retries must look it up while the server is closing
+	s.JoinGroup("workers", "CuriousCoyote")
+
+	if c, err = NewClient(ClientOpts{
+		Name:    clntName,
+		Token:   clntTkn,
+		Op:      op,
+		Loc:     grpcPort,
+		Workers: 2,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+
+	// Our member does not respond until released
+	release := make(chan struct{})
+	go c.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		<-release
+		return nil, nil
+	}, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	if _, err = s.RequestGroupCtx(ctx, "workers", req); err != context.DeadlineExceeded {
+		t.Errorf("Invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	cancel()
+
+	// Cancelled requests must not remain in flight
+	mc, _ := s.c.Get(clntChunk)
+	if n := atomic.LoadInt32(&mc.inflight); n != 0 {
+		t.Errorf("Invalid in-flight requests, expected 0 and received %d", n)
+	}
+
+	mc.rw.mux.RLock()
+	waiting := len(mc.rw.m)
+	mc.rw.mux.RUnlock()
+	if waiting != 0 {
+		t.Errorf("Invalid waiting requests, expected 0 and received %d", waiting)
+	}
+
+	// Closing the server while a group request is pending must not block
+	failed := make(chan error, 1)
+	if err = s.RequestGroup("workers", req, func(_ []byte, err error) {
+		failed <- err
+	}); err != nil {
+		t.Error("Error requesting group", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 2):
+		t.Error("Server did not close while a group request was pending")
+	}
+
+	if err = <-failed; err != ErrConnIsClosed {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnIsClosed, err)
+	}
+
+	close(release)
+	c.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestSpool(t *testing.T) {
+	var (
+		s    *Server
+		c    *Client
+		path string
+		err  error
+	)
+
+	if path, err = ioutil.TempDir("", "mq-spool"); err != nil {
+		t.Error("Error creating spool directory", err)
+		return
+	}
+
+	defer os.RemoveAll(path)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:         srvName,
+		Loc:          splPort,
+		SpoolPath:    path,
+		SpoolMaxSize: 8,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Our client has not connected yet, statements should be spooled
+	msgs := []string{"one", "two"}
+	for _, m := range msgs {
+		if err = s.Statement(clntName, []byte(m)); err != nil {
+			t.Error("Error spooling statement", err)
+		}
+	}
+
+	if err = s.Statement(clntName, stmnt); err == nil {
+		t.Error("Expected spool to be full")
+	} else if _, ok := err.(*SpoolFullError); !ok {
+		t.Errorf("Invalid error, expected *SpoolFullError and received %v", err)
+	}
+
+	if err = s.Statement("NobodyNoWhere", stmnt); err != ErrConnDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnDoesNotExist, err)
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   splPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	for _, m := range msgs {
+		c.Receive(NewRec(nil, func(b []byte) {
+			if str := string(b); str != m {
+				t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", m, str)
+			}
+		}))
+	}
+
+	c.Close()
+
+	// Spooled statements must never be mistaken for the handshake response by reconnecting clients
+	for i := 0; i < 20; i++ {
+		for {
+			if cc, ok := s.c.Get(clntChunk); !ok || !cc.isConnected() {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		for _, m := range msgs {
+			if err = s.Statement(clntName, []byte(m)); err != nil {
+				t.Error("Error spooling statement", err)
+				break
+			}
+		}
+
+		if c, err = NewClient(ClientOpts{
+			Name:  clntName,
+			Token: clntTkn,
+			Op:    op,
+			Loc:   splPort,
+		}); err != nil {
+			t.Error("Error getting new client", err)
+			return
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(time.Second * 2):
+			t.Errorf("Client did not connect after reconnecting %d times", i)
+			c.Close()
+			s.Close()
+			return
+		}
+
+		for _, m := range msgs {
+			c.Receive(NewRec(nil, func(b []byte) {
+				if str := string(b); str != m {
+					t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", m, str)
+				}
+			}))
+		}
+
+		c.Close()
+	}
+
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+type knownAuth struct {
+	known Chunk
+}
+
+func (k *knownAuth) Authenticate(hs Handshake) (meta interface{}, ok bool) {
+	return nil, hs.Key == k.known && hs.VerifyToken(clntTknChunk)
+}
+
+func (k *knownAuth) KnownKey(key Chunk) bool {
+	return key == k.known
+}
+
+func TestSpoolKnownKey(t *testing.T) {
+	var (
+		s    *Server
+		c    *Client
+		path string
+		err  error
+	)
+
+	if path, err = ioutil.TempDir("", "mq-spool"); err != nil {
+		t.Error("Error creating spool directory", err)
+		return
+	}
+
+	defer os.RemoveAll(path)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	// Our Authenticator knows of our client even though it has no token and has not connected
+	if s, err = NewServer(ServerOpts{
+		Name:      srvName,
+		Loc:       skPort,
+		Auth:      &knownAuth{known: clntChunk},
+		SpoolPath: path,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	if err = s.Statement(clntName, stmnt); err != nil {
+		t.Error("Error spooling statement", err)
+	}
+
+	if err = s.Statement("NobodyNoWhere", stmnt); err != ErrConnDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnDoesNotExist, err)
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   skPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	c.Receive(NewRec(nil, func(b []byte) {
+		if str := string(b); str != string(stmnt) {
+			t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", stmnt, str)
+		}
+	}))
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestStatementAck(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:       srvName,
+		Loc:        ackPort,
+		AckTimeout: time.Millisecond * 100,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	var handled int32
+	go s.Serve(NewKeyRec(nil, func(key Chunk, b []byte) {
+		atomic.AddInt32(&handled, 1)
+	}))
+
+	if c, err = NewClient(ClientOpts{
+		Name:       clntName,
+		Token:      clntTkn,
+		Op:         op,
+		Loc:        ackPort,
+		AckTimeout: time.Millisecond * 100,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	if err = c.StatementAck(stmnt); err != nil {
+		t.Error("Error sending acknowledged statement", err)
+	}
+
+	// Retransmissions of a processed statement should be acknowledged without being processed again
+	m := msg{uuid.New(), mtStatement, statusReliable, stmnt}
+	c.acks.Put(m)
+	c.out.Put(m)
+	c.out.Put(m)
+
+	time.Sleep(time.Millisecond * 500)
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Errorf("Invalid number of processed statements, expected 2 and received %d", n)
+	}
+
+	if due, _ := c.acks.Due(0, defaultAckRetries); len(due) != 0 {
+		t.Errorf("Invalid number of unacknowledged statements, expected 0 and received %d", len(due))
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestAckRetries(t *testing.T) {
+	var (
+		s   *Server
+		nc  net.Conn
+		p   proto
+		dls []DeadLetter
+		err error
+	)
+
+	sink := NewMemDeadLetters(0)
+	if s, err = NewServer(ServerOpts{
+		Name:        srvName,
+		Loc:         arPort,
+		AckTimeout:  time.Millisecond * 100,
+		AckRetries:  2,
+		DeadLetters: sink,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Our peer supports acknowledged statements, but never acknowledges them
+	if nc, err = net.Dial("tcp", arPort); err != nil {
+		t.Error("Error dialing", err)
+		return
+	}
+
+	if _, p, err = clientHandshake(nc, clntChunk, clntTknChunk, false, protoCurrent); err != nil {
+		t.Error("Error performing handshake", err)
+		return
+	}
+
+	var sent int32
+	go func() {
+		for {
+			m, err := readMsg(nc, p.ver)
+			if err != nil {
+				return
+			}
+
+			if m.s == statusReliable {
+				atomic.AddInt32(&sent, 1)
+			}
+		}
+	}()
+
+	if err = s.StatementAck(clntName, stmnt); err != nil {
+		t.Error("Error sending acknowledged statement", err)
+	}
+
+	if v, _ := s.ErrC().Receive(true); v != ErrNotAcknowledged {
+		t.Errorf("Invalid error, expected %v and received %v", ErrNotAcknowledged, v)
+	}
+
+	// Statement is no longer sent once dropped, the original plus two retries
+	time.Sleep(time.Millisecond * 300)
+	if n := atomic.LoadInt32(&sent); n != 3 {
+		t.Errorf("Invalid number of sends, expected 3 and received %d", n)
+	}
+
+	if dls, _ = sink.List(); len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+	} else if dl := dls[0]; dl.Key != clntChunk || dl.Reason != ErrNotAcknowledged.Error() || string(dl.Body) != string(stmnt) {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	nc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestResumeRequests(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	received := make(chan struct{}, 2)
+	newServer := func(rec KeyReceiver) (s *Server, err error) {
+		// Workers are used so that both of our requests are received at once
+		if s, err = NewServer(ServerOpts{
+			Name:    srvName,
+			Loc:     rsmPort,
+			Workers: 2,
+		}); err != nil {
+			return
+		}
+
+		s.PutAuth(clntName, clntTkn)
+		go s.Serve(rec)
+		return
+	}
+
+	// Our first server never responds
+	if s, err = newServer(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		received <- struct{}{}
+		time.Sleep(time.Second * 5)
+		return nil, nil
+	}, nil)); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:           clntName,
+		Token:          clntTkn,
+		Op:             op,
+		Loc:            rsmPort,
+		ResumeRequests: true,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	lost := make(chan error, 1)
+	go func() {
+		_, err := c.RequestCtx(context.Background(), req)
+		lost <- err
+	}()
+
+	resumed := make(chan []byte, 1)
+	go func() {
+		resp, _ := c.RequestIdempotentCtx(context.Background(), req)
+		resumed <- resp
+	}()
+
+	<-received
+	<-received
+	s.Close()
+
+	if err = <-lost; err != ErrConnLost {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnLost, err)
+	}
+
+	if s, err = newServer(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		return []byte("ok"), nil
+	}, nil)); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	select {
+	case resp := <-resumed:
+		if string(resp) != "ok" {
+			t.Errorf("Invalid response, expected ok and received \"%s\"", resp)
+		}
+	case <-time.After(time.Second * 10):
+		t.Error("Idempotent request was not resumed after reconnecting")
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+// stallProxy forwards connections to a target. While stalled, nothing more is read from the connecting side,
+// so that its writes eventually block. Stalled connections are closed once dropped
+type stallProxy struct {
+	l net.Listener
+
+	stalled uint32
+	drop    chan struct{}
+}
+
+func newStallProxy(loc, target string) (p *stallProxy, err error) {
+	p = &stallProxy{drop: make(chan struct{})}
+	if p.l, err = net.Listen("tcp", loc); err != nil {
+		return nil, err
+	}
+
+	go p.listen(target)
+	return
+}
+
+func (p *stallProxy) listen(target string) {
+	for {
+		pc, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+
+		sc, err := net.Dial("tcp", target)
+		if err != nil {
+			pc.Close()
+			continue
+		}
+
+		go p.forward(pc, sc)
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := sc.Read(buf)
+				if err != nil {
+					break
+				}
+
+				if _, err = pc.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+
+			pc.Close()
+		}()
+	}
+}
+
+// forward will copy from pc to sc until stalled
+func (p *stallProxy) forward(pc, sc net.Conn) {
+	buf := make([]byte, 32*1024)
+	for atomic.LoadUint32(&p.stalled) == 0 {
+		n, err := pc.Read(buf)
+		if err != nil {
+			break
+		}
+
+		if _, err = sc.Write(buf[:n]); err != nil {
+			break
+		}
+	}
+
+	if atomic.LoadUint32(&p.stalled) == 1 {
+		<-p.drop
+	}
+
+	pc.Close()
+	sc.Close()
+}
+
+// Stall will stop reading from the connecting side
+func (p *stallProxy) Stall() {
+	atomic.StoreUint32(&p.stalled, 1)
+}
+
+// Drop will close the stalled connections, new connections are forwarded as usual
+func (p *stallProxy) Drop() {
+	atomic.StoreUint32(&p.stalled, 0)
+	close(p.drop)
+}
+
+func (p *stallProxy) Close() error {
+	return p.l.Close()
+}
+
+func TestHeartbeatBlackhole(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		p   *stallProxy
+		err error
+	)
+
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  hbbPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Once our proxy is stalled, nothing reaches the server and the client's writes block
+	if p, err = newStallProxy(hbpPort, hbbPort); err != nil {
+		t.Error("Error getting new proxy", err)
+		return
+	}
+
+	connected := make(chan struct{}, 2)
+	disconnected := make(chan error, 2)
+	op := NewReasonOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, func(ch Chunk, reason error) {
+		disconnected <- reason
+	})
+
+	if c, err = NewClient(ClientOpts{
+		Name:            clntName,
+		Token:           clntTkn,
+		Op:              op,
+		Loc:             hbpPort,
+		Heartbeat:       time.Millisecond * 200,
+		HeartbeatMisses: 2,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	p.Stall()
+
+	// Statements are large enough that the sender blocks writing to the net.Conn
+	for i := 0; i < 16; i++ {
+		c.Statement(make([]byte, 1024*1024))
+	}
+
+	select {
+	case reason := <-disconnected:
+		if reason != ErrHeartbeat {
+			t.Errorf("Invalid reason, expected %v and received %v", ErrHeartbeat, reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("Heartbeat did not close the blackholed conn")
+	}
+
+	p.Drop()
+	c.Close()
+	p.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestResumeUnsentRequests(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		err error
+	)
+
+	const reqCount = 16
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  rsqPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+	received := make(chan byte, reqCount)
+	go s.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		received <- b[0]
+		return b[:1], nil
+	}, nil))
+
+	// Our client connects through a proxy, requests queued while it is stalled cannot be written and
+	// are dropped along with the proxied connection
+	var p *stallProxy
+	if p, err = newStallProxy(prxPort, rsqPort); err != nil {
+		t.Error("Error getting new proxy", err)
+		return
+	}
+
+	connected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if c, err = NewClient(ClientOpts{
+		Name:           clntName,
+		Token:          clntTkn,
+		Op:             op,
+		Loc:            prxPort,
+		ResumeRequests: true,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	p.Stall()
+
+	// Requests are large enough that the later ones cannot fit within the socket buffers
+	resps := make(chan error, reqCount)
+	for i := 0; i < reqCount; i++ {
+		b := make([]byte, 1024*1024)
+		b[0] = byte(i)
+		idx := byte(i)
+		if err = c.RequestErr(b, func(resp []byte, err error) {
+			if err == nil && (len(resp) != 1 || resp[0] != idx) {
+				err = fmt.Errorf("invalid response for request %d: %v", idx, resp)
+			}
+
+			resps <- err
+		}); err != nil {
+			t.Error("Error sending request", err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 500)
+	p.Drop()
+
+	var resumed int
+	for i := 0; i < reqCount; i++ {
+		select {
+		case err = <-resps:
+		case <-time.After(time.Second * 10):
+			t.Error("Timed out waiting for responses")
+			c.Close()
+			p.Close()
+			s.Close()
+			return
+		}
+
+		switch err {
+		case nil:
+			resumed++
+		case ErrConnLost:
+			// Request was written before the connection was lost
+		default:
+			t.Error("Error received", err)
+		}
+	}
+
+	if resumed == 0 {
+		t.Error("Expected requests which were not written to be resumed after reconnecting")
+	}
+
+	// Resumed requests must reach the server in the order they were sent
+	last := -1
+	for i := 0; i < resumed; i++ {
+		idx := int(<-received)
+		if idx <= last {
+			t.Errorf("Invalid order, received request %d after request %d", idx, last)
+		}
+
+		last = idx
+	}
+
+	c.Close()
+	p.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func BenchmarkStatement(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s.Statement(clntName, stmnt)
+	}
+
+	b.ReportAllocs()
+}
+
+func BenchmarkRequest(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s.Request(clntName, req, func(b []byte) {
+			respVal = b
+		})
+	}
+
+	b.ReportAllocs()
+}
+
+func TestDeadLetters(t *testing.T) {
+	var (
+		s    *Server
+		c    *Client
+		dls  []DeadLetter
+		path string
+		err  error
+	)
+
+	if path, err = ioutil.TempDir("", "mq-deadletters"); err != nil {
+		t.Error("Error creating dead letter directory", err)
+		return
+	}
+
+	defer os.RemoveAll(path)
+
+	var sink *DBDeadLetters
+	if sink, err = NewDBDeadLetters(path); err != nil {
+		t.Error("Error getting new dead-letter sink", err)
+		return
+	}
+
+	defer sink.Close()
+
+	connected := make(chan struct{}, 1)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:        srvName,
+		Loc:         dlPort,
+		DeadLetters: sink,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+
+	// Our client has not connected yet, the statement should become a dead letter
+	if err = s.Statement(clntName, stmnt); err != ErrConnDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnDoesNotExist, err)
+	}
+
+	if dls, err = s.DeadLetters(); err != nil {
+		t.Error("Error listing dead letters", err)
+		return
+	} else if len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+		return
+	}
+
+	dl := dls[0]
+	if dl.Key.String() != clntName || string(dl.Body) != string(stmnt) || dl.Request || dl.Inbound {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	if dl.Reason != ErrConnDoesNotExist.Error() {
+		t.Errorf("Invalid reason, expected \"%v\" and received \"%s\"", ErrConnDoesNotExist, dl.Reason)
+	}
+
+	if c, err = NewClient(ClientOpts{
+		Name:  clntName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   dlPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	if err = s.Replay(dl.ID, nil); err != nil {
+		t.Error("Error replaying dead letter", err)
+	}
+
+	c.Receive(NewRec(nil, func(b []byte) {
+		if str := string(b); str != string(stmnt) {
+			t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", stmnt, str)
+		}
+	}))
+
+	// Replayed dead letters are removed
+	if dls, _ = s.DeadLetters(); len(dls) != 0 {
+		t.Errorf("Invalid number of dead letters, expected 0 and received %d", len(dls))
+	}
+
+	if err = s.Replay(dl.ID, nil); err != ErrDeadLetterDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterDoesNotExist, err)
+	}
+
+	if err = c.Replay(dl.ID, nil); err != ErrNoDeadLetterSink {
+		t.Errorf("Invalid error, expected %v and received %v", ErrNoDeadLetterSink, err)
+	}
+
+	// In-memory sink discards the oldest dead letter once full
+	mem := NewMemDeadLetters(2)
+	for i := 0; i < 3; i++ {
+		mem.Put(DeadLetter{ID: uuid.New(), Body: []byte{byte(i)}})
+	}
+
+	if dls, _ = mem.List(); len(dls) != 2 || dls[0].Body[0] != 1 || dls[1].Body[0] != 2 {
+		t.Errorf("Invalid in-memory dead letters: %+v", dls)
+	}
+
+	c.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestMemDeadLetters(t *testing.T) {
+	var (
+		dl  DeadLetter
+		dls []DeadLetter
+		err error
+	)
+
+	mem := NewMemDeadLetters(0)
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for i, id := range ids {
+		mem.Put(DeadLetter{ID: id, Body: []byte{byte(i)}})
+	}
+
+	if dl, err = mem.Get(ids[1]); err != nil {
+		t.Error("Error getting dead letter", err)
+	} else if dl.ID != ids[1] || dl.Body[0] != 1 {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	if _, err = mem.Get(uuid.New()); err != ErrDeadLetterDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterDoesNotExist, err)
+	}
+
+	if err = mem.Delete(ids[1]); err != nil {
+		t.Error("Error deleting dead letter", err)
+	}
+
+	if err = mem.Delete(ids[1]); err != ErrDeadLetterDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterDoesNotExist, err)
+	}
+
+	if _, err = mem.Get(ids[1]); err != ErrDeadLetterDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterDoesNotExist, err)
+	}
+
+	// Remaining dead letters keep their order
+	if dls, _ = mem.List(); len(dls) != 2 || dls[0].ID != ids[0] || dls[1].ID != ids[2] {
+		t.Errorf("Invalid in-memory dead letters: %+v", dls)
+	}
+}
+
+func TestClientDeadLetters(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		tc  *Client
+		dls []DeadLetter
+		err error
+	)
+
+	const tgtName = "SnoozingSloth"
+	connected := make(chan Chunk, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- ch
+		return nil
+	}, nil)
+
+	if s, err = NewServer(ServerOpts{
+		Name:    srvName,
+		Loc:     cdlPort,
+		Routing: true,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+	s.PutAuth(tgtName, clntTkn)
+	go s.Serve(NewKeyRec(func(key Chunk, b []byte) ([]byte, error) {
+		// Respond after our client has stopped waiting
+		time.Sleep(time.Millisecond * 300)
+		return []byte("late"), nil
+	}, nil))
+
+	sink := NewMemDeadLetters(0)
+	if c, err = NewClient(ClientOpts{
+		Name:        clntName,
+		Token:       clntTkn,
+		Op:          op,
+		Loc:         cdlPort,
+		DeadLetters: sink,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+
+	// The response arrives after the request was abandoned, it should become an inbound dead letter
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	if _, err = c.RequestCtx(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	cancel()
+	if dls = waitDeadLetters(sink, 1); len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+		c.Close()
+		s.Close()
+		return
+	}
+
+	dl := dls[0]
+	if !dl.Inbound || dl.Request || dl.Routed || string(dl.Body) != "late" {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	if dl.Reason != ErrReqFnDoesNotExist.Error() {
+		t.Errorf("Invalid reason, expected \"%v\" and received \"%s\"", ErrReqFnDoesNotExist, dl.Reason)
+	}
+
+	if err = c.Replay(dl.ID, nil); err != ErrDeadLetterInbound {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterInbound, err)
+	}
+
+	sink.Delete(dl.ID)
+
+	// Our target has not connected, the server returns the statement so it should become a routed dead letter
+	if err = c.StatementTo(tgtName, stmnt); err != nil {
+		t.Error("Error sending statement", err)
+	}
+
+	if dls = waitDeadLetters(sink, 1); len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+		c.Close()
+		s.Close()
+		return
+	}
+
+	dl = dls[0]
+	if !dl.Routed || dl.Inbound || dl.Request || dl.Key.String() != tgtName || string(dl.Body) != string(stmnt) {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	if dl.Reason != ErrTargetOffline.Error() {
+		t.Errorf("Invalid reason, expected \"%v\" and received \"%s\"", ErrTargetOffline, dl.Reason)
+	}
+
+	if tc, err = NewClient(ClientOpts{
+		Name:  tgtName,
+		Token: clntTkn,
+		Op:    op,
+		Loc:   cdlPort,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		c.Close()
+		s.Close()
+		return
+	}
+
+	<-connected
+	replayed := make(chan string, 1)
+	go tc.Serve(NewKeyRec(nil, func(key Chunk, b []byte) {
+		if key != clntChunk {
+			t.Errorf("Invalid sender, expected %s and received %s", clntName, key)
+		}
+
+		replayed <- string(b)
+	}))
+
+	if err = c.Replay(dl.ID, nil); err != nil {
+		t.Error("Error replaying dead letter", err)
+	}
+
+	select {
+	case str := <-replayed:
+		if str != string(stmnt) {
+			t.Errorf("Incorrect message, expected \"%s\" and we received \"%s\"", stmnt, str)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("Replayed statement was not received")
+	}
+
+	if _, err = sink.Get(dl.ID); err != ErrDeadLetterDoesNotExist {
+		t.Errorf("Invalid error, expected %v and received %v", ErrDeadLetterDoesNotExist, err)
+	}
+
+	// Requests which are waiting for a response when the client is closed should become dead letters
+	failed := make(chan error, 1)
+	if err = c.RequestErr(req, func(_ []byte, err error) {
+		failed <- err
+	}); err != nil {
+		t.Error("Error sending request", err)
+	}
+
+	c.Close()
+	if err = <-failed; err != ErrConnIsClosed {
+		t.Errorf("Invalid error, expected %v and received %v", ErrConnIsClosed, err)
+	}
+
+	if dls, _ = sink.List(); len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+	} else if dl = dls[0]; !dl.Request || dl.Inbound || dl.Reason != ErrConnIsClosed.Error() || string(dl.Body) != string(req) {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	}
+
+	tc.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+func TestInboundQueueDeadLetter(t *testing.T) {
+	var (
+		dls []DeadLetter
+		err error
+	)
+
+	sink := NewMemDeadLetters(0)
+	co := newConnOpts(0, 0, 0)
+	co.dl = sink
+	c := newConn(clntChunk, nil, nil, nil, chanchan.NewChanChan(4, 12, chanchan.FullPush), co)
+
+	// Messages which cannot be put in the inbound queue should become inbound dead letters
+	c.inbound().Close(true)
+	if err = c.process(msg{uuid.New(), mtStatement, statusOK, []byte(string(stmnt))}); err == nil {
+		t.Error("Expected an error when the inbound queue is closed")
+	}
+
+	if dls, _ = sink.List(); len(dls) != 1 {
+		t.Errorf("Invalid number of dead letters, expected 1 and received %d", len(dls))
+	} else if dl := dls[0]; !dl.Inbound || dl.Request || dl.Key != clntChunk || string(dl.Body) != string(stmnt) {
+		t.Errorf("Invalid dead letter: %+v", dl)
+	} else if dl.Reason != err.Error() {
+		t.Errorf("Invalid reason, expected \"%v\" and received \"%s\"", err, dl.Reason)
+	}
+}
+
+func TestDeadLetterDrain(t *testing.T) {
+	var (
+		s   *Server
+		c   *Client
+		p   *stallProxy
+		dls []DeadLetter
+		err error
+	)
+
+	const stmntCount = 16
+	if s, err = NewServer(ServerOpts{
+		Name: srvName,
+		Loc:  drnPort,
+	}); err != nil {
+		t.Error("Error getting new server", err)
+		return
+	}
+
+	s.PutAuth(clntName, clntTkn)
+	received := make(chan byte, stmntCount)
+	go s.Serve(NewKeyRec(nil, func(key Chunk, b []byte) {
+		received <- b[0]
+	}))
+
+	// Statements queued while our proxy is stalled cannot be written before the connection is dropped
+	if p, err = newStallProxy(dprPort, drnPort); err != nil {
+		t.Error("Error getting new proxy", err)
+		return
+	}
+
+	connected := make(chan struct{}, 2)
+	op := NewOp(func(ch Chunk) error {
+		connected <- struct{}{}
+		return nil
+	}, nil)
+
+	sink := NewMemDeadLetters(0)
+	if c, err = NewClient(ClientOpts{
+		Name:        clntName,
+		Token:       clntTkn,
+		Op:          op,
+		Loc:         dprPort,
+		DeadLetters: sink,
+	}); err != nil {
+		t.Error("Error getting new client", err)
+		return
+	}
+
+	<-connected
+	p.Stall()
+
+	// Statements are large enough that the later ones cannot fit within the socket buffers
+	for i := 0; i < stmntCount; i++ {
+		b := make([]byte, 1024*1024)
+		b[0] = byte(i)
+		if err = c.Statement(b); err != nil {
+			t.Error("Error sending statement", err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 500)
+	p.Drop()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second * 10):
+		t.Error("Client did not reconnect")
+		c.Close()
+		p.Close()
+		s.Close()
+		return
+	}
+
+	if dls, _ = sink.List(); len(dls) == 0 {
+		t.Error("Expected statements which were not written to become dead letters")
+	}
+
+	for _, dl := range dls {
+		if dl.Request || dl.Inbound || dl.Reason != ErrConnIsClosed.Error() || len(dl.Body) != 1024*1024 {
+			t.Errorf("Invalid dead letter: %+v", dl)
+		}
+
+		if err = c.Replay(dl.ID, nil); err != nil {
+			t.Error("Error replaying dead letter", err)
+		}
+	}
+
+	// Each replayed statement should reach the server
+	for range dls {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Error("Replayed statement was not received")
+		}
+	}
+
+	c.Close()
+	p.Close()
+	s.Close()
+	time.Sleep(time.Second * 1)
+}
+
+// waitDeadLetters will wait until the sink holds n dead letters, or a second has passed
+func waitDeadLetters(sink DeadLetterSink, n int) (dls []DeadLetter) {
+	for i := 0; i < 100; i++ {
+		if dls, _ = sink.List(); len(dls) >= n {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return
 }
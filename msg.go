@@ -1,8 +1,6 @@
 package mq
 
 import (
-	"unsafe"
-
 	"github.com/missionMeteora/binny.v2"
 	"github.com/missionMeteora/jump/uuid"
 )
@@ -15,8 +13,8 @@ type msg struct {
 	body []byte
 }
 
-// Bytes will return a representation of it's contents in the form of a byteslice
-func (m *msg) Bytes(b []byte) (out []byte, n int) {
+// Bytes will return a representation of it's contents in the form of a byteslice, encoded for the provided protocol version
+func (m *msg) Bytes(b []byte, ver uint8) (out []byte, n int) {
 	blen := int64(len(m.body))
 	// Set the message type at index 24
 	b[24] = byte(m.t)
@@ -25,7 +23,7 @@ func (m *msg) Bytes(b []byte) (out []byte, n int) {
 	// Copy id from index zero to (not including) index sixteen
 	copy(b[:16], m.id[:])
 	// Copy body length value (as a byteslice) from index sixteen to index twenty-four (not including)
-	copy(b[16:24], (*[8]byte)(unsafe.Pointer(&blen))[:])
+	byteOrder(ver).PutUint64(b[16:24], uint64(blen))
 	if m.body != nil {
 		// If body exists for message, copy body from index twenty-five until the end of the body
 		copy(b[26:], m.body)
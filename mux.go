@@ -0,0 +1,121 @@
+package mq
+
+import "sync"
+
+// NewMethodMsg returns a message body prefixed with the provided method name, for use with a Mux
+// Message layout:
+//   - Method name length: 1 byte
+//   - Method name: 1 to 255 bytes
+//   - Body: remaining bytes
+func NewMethodMsg(method string, body []byte) (b []byte, err error) {
+	if len(method) == 0 || len(method) > 255 {
+		err = ErrInvalidMethod
+		return
+	}
+
+	b = make([]byte, 0, 1+len(method)+len(body))
+	b = append(b, uint8(len(method)))
+	b = append(b, method...)
+	b = append(b, body...)
+	return
+}
+
+// ParseMethodMsg returns the method name and body of a message created by NewMethodMsg
+// Note: The returned body references the provided byteslice
+func ParseMethodMsg(b []byte) (method string, body []byte, err error) {
+	if len(b) == 0 || b[0] == 0 || len(b) < 1+int(b[0]) {
+		err = ErrNoMethod
+		return
+	}
+
+	n := 1 + int(b[0])
+	method = string(b[1:n])
+	body = b[n:]
+	return
+}
+
+// NewMux returns a pointer to a new instance of Mux
+func NewMux() *Mux {
+	return &Mux{
+		m: make(map[string]KeyReceiver),
+	}
+}
+
+// Mux is a KeyReceiver which routes messages to handlers by method name
+// Note: Messages are expected to be created by NewMethodMsg. Requests for a method without a handler are
+// answered with ErrUnknownMethod, unless a fallback has been set
+type Mux struct {
+	mux sync.RWMutex
+
+	// Handlers by method name
+	m map[string]KeyReceiver
+	// Fallback handler, used for unknown methods and messages without a method name
+	fb KeyReceiver
+}
+
+// Handle will set the handler for the provided method, an existing handler is replaced
+// Note: Handlers are passed the message body which follows the method name
+func (m *Mux) Handle(method string, rec KeyReceiver) (err error) {
+	if len(method) == 0 || len(method) > 255 {
+		return ErrInvalidMethod
+	}
+
+	m.mux.Lock()
+	m.m[method] = rec
+	m.mux.Unlock()
+	return
+}
+
+// HandleFunc will set the request and statement funcs for the provided method, either may be nil
+func (m *Mux) HandleFunc(method string, res func(Chunk, []byte) ([]byte, error), stmnt func(Chunk, []byte)) error {
+	return m.Handle(method, NewKeyRec(res, stmnt))
+}
+
+// Remove will remove the handler for the provided method
+func (m *Mux) Remove(method string) {
+	m.mux.Lock()
+	delete(m.m, method)
+	m.mux.Unlock()
+}
+
+// Fallback will set the handler for messages which do not match a method, it is passed the entire message
+func (m *Mux) Fallback(rec KeyReceiver) {
+	m.mux.Lock()
+	m.fb = rec
+	m.mux.Unlock()
+}
+
+// route returns the handler and body for the provided message, rec is nil when no handler matches
+func (m *Mux) route(b []byte) (rec KeyReceiver, body []byte) {
+	method, body, err := ParseMethodMsg(b)
+
+	m.mux.RLock()
+	if err == nil {
+		rec = m.m[method]
+	}
+
+	if rec == nil && m.fb != nil {
+		// No handler matches, use the fallback with the entire message
+		rec, body = m.fb, b
+	}
+	m.mux.RUnlock()
+	return
+}
+
+// Response will route the request to the handler for it's method
+func (m *Mux) Response(key Chunk, b []byte) ([]byte, error) {
+	rec, body := m.route(b)
+	if rec == nil {
+		return nil, ErrUnknownMethod
+	}
+
+	return rec.Response(key, body)
+}
+
+// Statement will route the statement to the handler for it's method
+// Note: Statements for a method without a handler are dropped, unless a fallback has been set
+func (m *Mux) Statement(key Chunk, b []byte) {
+	if rec, body := m.route(b); rec != nil {
+		rec.Statement(key, body)
+	}
+}
@@ -1,6 +1,9 @@
 package mq
 
 import (
+	"crypto/tls"
+	"time"
+
 	"github.com/go-ini/ini"
 )
 
@@ -18,6 +21,15 @@ func NewServerOpts(v interface{}) (opts ServerOpts, err error) {
 		return
 	}
 
+	if opts.TLS, err = newTLSConfig(opts.CertFile, opts.KeyFile, opts.CAFile); err != nil {
+		return
+	}
+
+	if opts.TLS != nil && len(opts.CAFile) > 0 {
+		// Certificate authority has been provided, verify client certificates when they are given
+		opts.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
 	for _, sec := range f.Sections() {
 		if sec.Name() == ini.DEFAULT_SECTION {
 			continue
@@ -48,8 +60,79 @@ type ServerOpts struct {
 	Name string `ini:"name"`
 	Loc  string `ini:"location"`
 
+	// TLS certificate, key and certificate authority paths, used to populate TLS
+	CertFile string `ini:"certFile"`
+	KeyFile  string `ini:"keyFile"`
+	CAFile   string `ini:"caFile"`
+	// When true, clients must present a certificate signed by the CA. The common name
+	// of the certificate is used as the client's key and the token is not checked
+	CertAuth bool `ini:"certAuth"`
+	// When true, clients must use the challenge-response handshake. Leave false while older clients
+	// which send their raw token are still deployed
+	RequireChallenge bool `ini:"requireChallenge"`
+	// Minimum protocol version accepted from clients, clients using an older version are rejected with
+	// a VersionError. Legacy clients which predate protocol versioning use version one (accepted when zero)
+	MinProtocolVersion uint8 `ini:"minProtocolVersion"`
+
+	// Time allowed for clients to complete the handshake (defaults to 10 seconds)
+	HandshakeTimeout time.Duration `ini:"handshakeTimeout"`
+	// Maximum number of handshakes in progress at once (defaults to 128)
+	// Note: New connections are not accepted while the maximum is reached
+	MaxPendingHandshakes int `ini:"maxPendingHandshakes"`
+
+	// Interval between heartbeat pings sent to each client, heartbeats are disabled when zero
+	// Note: Clients which do not support heartbeats will not be sent pings
+	Heartbeat time.Duration `ini:"heartbeat"`
+	// Number of consecutive missed heartbeats allowed before a client is disconnected (defaults to 3)
+	HeartbeatMisses int `ini:"heartbeatMisses"`
+
+	// Maximum size (in bytes) of inbound message bodies, unlimited when zero
+	// Note: Clients sending larger messages are disconnected
+	MaxBodySize int64 `ini:"maxBodySize"`
+
+	// Number of workers processing messages received by Serve and ReceiveAny, shared by every client.
+	// Messages from each client are processed one at a time when zero
+	// Note: While every worker is busy, no further messages are processed
+	Workers int `ini:"workers"`
+	// When true, statements are processed in the order they arrive rather than by workers
+	OrderedStatements bool `ini:"orderedStatements"`
+
+	// Time to wait for an acknowledgement before an acknowledged statement is sent again (defaults to 5 seconds)
+	AckTimeout time.Duration `ini:"ackTimeout"`
+
+	// Number of times an acknowledged statement is sent again before it is dropped (defaults to 10)
+	AckRetries int `ini:"ackRetries"`
+
+	// When true, clients may send messages to each other through the server (see Client.StatementTo)
+	// Note: Routes can be restricted by an Authenticator which implements RouteAuthenticator
+	Routing bool `ini:"routing"`
+
+	// Path of the spool database. When set, statements to known keys which are not connected are
+	// stored and sent in order once the key reconnects. Keys are known once they have connected or have a token
+	// Note: Keys which only authenticate through a custom Authenticator or a client certificate are unknown until
+	// they connect, unless the Authenticator implements KeyAuthenticator
+	SpoolPath string `ini:"spoolPath"`
+	// Maximum size (in bytes) of the statements spooled for each key, unlimited when zero
+	// Note: Statements which would exceed the maximum return a *SpoolFullError
+	SpoolMaxSize int64 `ini:"spoolMaxSize"`
+	// Maximum age of spooled statements, older statements are discarded rather than sent. Unlimited when zero
+	SpoolMaxAge time.Duration `ini:"spoolMaxAge"`
+
 	Clients []KeyToken
 
+	// Middleware called for every inbound message before the Receiver, the first is called first
+	Middleware []Middleware `ini:"-"`
+
+	// Sink for messages which could not be delivered or processed, dead letters are not kept when nil
+	// Note: See NewMemDeadLetters and NewDBDeadLetters
+	DeadLetters DeadLetterSink `ini:"-"`
+
+	// Authenticator for connecting clients, Clients and the Auth methods of Server are used when nil
+	Auth Authenticator `ini:"-"`
+
+	// When set, the server will only accept TLS connections
+	TLS *tls.Config `ini:"-"`
+
 	Op Operator
 }
 
@@ -67,6 +150,14 @@ func NewClientOpts(v interface{}) (opts ClientOpts, err error) {
 		return
 	}
 
+	if opts.TLS, err = newTLSConfig(opts.CertFile, opts.KeyFile, opts.CAFile); err != nil {
+		return
+	}
+
+	if opts.TLS != nil {
+		opts.TLS.ServerName = opts.ServerName
+	}
+
 	return
 }
 
@@ -76,5 +167,54 @@ type ClientOpts struct {
 	Token string `ini:"token"`
 	Loc   string `ini:"location"`
 
+	// TLS certificate, key and certificate authority paths, used to populate TLS
+	// Note: Certificate and key are only needed when the server requires client certificates
+	CertFile string `ini:"certFile"`
+	KeyFile  string `ini:"keyFile"`
+	CAFile   string `ini:"caFile"`
+	// Name used to verify the server's certificate
+	ServerName string `ini:"serverName"`
+	// When true, the token is proven with a challenge-response handshake rather than being sent
+	// Note: Requires a server which supports challenge-response
+	Challenge bool `ini:"challenge"`
+	// When true, the legacy handshake and native byte order wire format are used. This is only
+	// needed to reach servers which predate protocol versioning, they reject the versioned handshake
+	LegacyProtocol bool `ini:"legacyProtocol"`
+
+	// Interval between heartbeat pings sent to the server, heartbeats are disabled when zero
+	// Note: Servers which do not support heartbeats will not be sent pings
+	Heartbeat time.Duration `ini:"heartbeat"`
+	// Number of consecutive missed heartbeats allowed before reconnecting to the server (defaults to 3)
+	HeartbeatMisses int `ini:"heartbeatMisses"`
+
+	// Maximum size (in bytes) of inbound message bodies, unlimited when zero
+	// Note: The connection is closed when the server sends a larger message
+	MaxBodySize int64 `ini:"maxBodySize"`
+
+	// Number of workers processing messages received by Serve, messages are processed one at a time when zero
+	Workers int `ini:"workers"`
+	// When true, statements are processed in the order they arrive rather than by workers
+	OrderedStatements bool `ini:"orderedStatements"`
+
+	// Time to wait for an acknowledgement before an acknowledged statement is sent again (defaults to 5 seconds)
+	AckTimeout time.Duration `ini:"ackTimeout"`
+
+	// Number of times an acknowledged statement is sent again before it is dropped (defaults to 10)
+	AckRetries int `ini:"ackRetries"`
+
+	// When true, pending requests survive reconnecting to the server. Requests which had not been sent are
+	// sent once reconnected, requests which had been sent fail with ErrConnLost unless they are idempotent
+	ResumeRequests bool `ini:"resumeRequests"`
+
+	// Middleware called for every inbound message before the Receiver, the first is called first
+	Middleware []Middleware `ini:"-"`
+
+	// Sink for messages which could not be delivered or processed, dead letters are not kept when nil
+	// Note: See NewMemDeadLetters and NewDBDeadLetters
+	DeadLetters DeadLetterSink `ini:"-"`
+
+	// When set, the client will dial the server using TLS
+	TLS *tls.Config `ini:"-"`
+
 	Op Operator
 }
@@ -0,0 +1,118 @@
+package mq
+
+import (
+	"strings"
+	"sync"
+)
+
+// TopicFunc is called with messages published to a subscribed topic
+type TopicFunc func(topic string, b []byte)
+
+// validTopic returns whether or not the provided topic is valid. Topics consist of tokens separated by dots
+// Note: When wildcards is true, a "*" token matches any single token and a final ">" token matches one or more tokens
+func validTopic(topic string, wildcards bool) bool {
+	if len(topic) == 0 || len(topic) > 255 {
+		return false
+	}
+
+	tkns := strings.Split(topic, ".")
+	for i, tkn := range tkns {
+		switch {
+		case len(tkn) == 0:
+			return false
+		case tkn == "*", tkn == ">" && i == len(tkns)-1:
+			if !wildcards {
+				return false
+			}
+		case strings.ContainsAny(tkn, "*>"):
+			// Wildcards must be entire tokens
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchTopic returns whether or not the provided topic matches the provided pattern
+func matchTopic(pattern, topic string) bool {
+	ptkns := strings.Split(pattern, ".")
+	tkns := strings.Split(topic, ".")
+	for i, ptkn := range ptkns {
+		switch {
+		case ptkn == ">":
+			// Matches the remaining tokens, at least one must remain
+			return i < len(tkns)
+		case i >= len(tkns):
+			return false
+		case ptkn != "*" && ptkn != tkns[i]:
+			return false
+		}
+	}
+
+	return len(ptkns) == len(tkns)
+}
+
+// newSubs returns a pointer to a new instance of subs
+func newSubs() *subs {
+	return &subs{
+		m: make(map[string]TopicFunc),
+	}
+}
+
+// subs manages the topic subscriptions of a conn
+// Note: Clients store the TopicFunc for each pattern, servers only store the patterns
+type subs struct {
+	mux sync.RWMutex
+
+	// TopicFuncs by pattern
+	m map[string]TopicFunc
+}
+
+// Put will set the TopicFunc for the provided pattern
+func (s *subs) Put(pattern string, fn TopicFunc) {
+	s.mux.Lock()
+	s.m[pattern] = fn
+	s.mux.Unlock()
+}
+
+// Delete will remove the provided pattern
+func (s *subs) Delete(pattern string) {
+	s.mux.Lock()
+	delete(s.m, pattern)
+	s.mux.Unlock()
+}
+
+// Reset will remove every pattern
+func (s *subs) Reset() {
+	s.mux.Lock()
+	s.m = make(map[string]TopicFunc)
+	s.mux.Unlock()
+}
+
+// Match returns the TopicFuncs of the patterns matching the provided topic, ok is true when any pattern matches
+func (s *subs) Match(topic string) (fns []TopicFunc, ok bool) {
+	s.mux.RLock()
+	for pattern, fn := range s.m {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+
+		ok = true
+		if fn != nil {
+			fns = append(fns, fn)
+		}
+	}
+	s.mux.RUnlock()
+	return
+}
+
+// List returns a list of the subscribed patterns
+func (s *subs) List() (l []string) {
+	s.mux.RLock()
+	l = make([]string, 0, len(s.m))
+	for pattern := range s.m {
+		l = append(l, pattern)
+	}
+	s.mux.RUnlock()
+	return
+}
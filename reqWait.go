@@ -1,6 +1,7 @@
 package mq
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/missionMeteora/jump/uuid"
@@ -8,46 +9,142 @@ import (
 
 func newReqWait() *reqWait {
 	return &reqWait{
-		m: make(map[uuid.UUID]ReqFunc),
+		m: make(map[uuid.UUID]*waiter),
 	}
 }
 
-// reqWait is for holding onto a RespFunc while waiting for an outbound request
+// reqWait is for holding onto a response func while waiting for an outbound request
+// Note: Response funcs are called with an error when the request could not be completed
 type reqWait struct {
 	// TODO (Josh): See about utilizing the R functionality
 	mux sync.RWMutex
-	m   map[uuid.UUID]ReqFunc
+	m   map[uuid.UUID]*waiter
+	// Sequence of the last request, used to return requests in the order they were first sent
+	seq uint64
 }
 
-// Get returns a RespFunc and an ok status
-func (rw *reqWait) Get(id uuid.UUID) (fn ReqFunc, ok bool) {
+// waiter is a response func waiting for it's response
+type waiter struct {
+	fn ReqErrFunc
+
+	// Request message
+	m msg
+	// Order in which the request was first sent
+	seq uint64
+	// True for requests which are resumed after reconnecting
+	resume bool
+	// When true, the request is sent again if the connection is lost after it was sent
+	idem bool
+	// True once the request has been put in the outbound queue of the current net.Conn
+	queued bool
+	// True once the request has been written to the current net.Conn
+	sent bool
+}
+
+// Get returns a response func and an ok status
+func (rw *reqWait) Get(id uuid.UUID) (fn ReqErrFunc, ok bool) {
+	var w *waiter
 	rw.mux.Lock()
-	if fn, ok = rw.m[id]; ok {
+	if w, ok = rw.m[id]; ok {
 		// If entry exists, we need to remove it from the list
 		// Note: Think of the ReqFunc as being checked-in during Put
 		// and checked-out during Get.
 		delete(rw.m, id)
+		fn = w.fn
 	}
 	rw.mux.Unlock()
 	return
 }
 
-// Put will set key of id with a value of the argument-provided fn
-func (rw *reqWait) Put(id uuid.UUID, fn ReqFunc) {
+// Put will set the response func for the provided request message
+func (rw *reqWait) Put(m msg, fn ReqErrFunc) {
+	rw.mux.Lock()
+	rw.seq++
+	rw.m[m.id] = &waiter{fn: fn, m: m, seq: rw.seq}
+	rw.mux.Unlock()
+}
+
+// PutResumable will set the response func for a request which is resumed after reconnecting
+// Note: When idem is true, the request is sent again even if it was sent before the connection was lost
+func (rw *reqWait) PutResumable(m msg, fn ReqErrFunc, idem bool) {
 	rw.mux.Lock()
-	rw.m[id] = fn
+	rw.seq++
+	rw.m[m.id] = &waiter{fn: fn, m: m, seq: rw.seq, resume: true, idem: idem, queued: true}
 	rw.mux.Unlock()
 }
 
+// Sent will mark the request with the provided id as written to the net.Conn
+func (rw *reqWait) Sent(id uuid.UUID) {
+	rw.mux.Lock()
+	if w, ok := rw.m[id]; ok {
+		w.sent = true
+	}
+	rw.mux.Unlock()
+}
+
+// Lost is used when the connection is lost but will be resumed. Requests which were sent and are not idempotent
+// are called with ErrConnLost, other resumable requests are kept so that they can be sent once reconnected
+// Note: Requests which cannot be resumed are called with ErrConnIsClosed and returned, oldest first
+func (rw *reqWait) Lost() (ms []msg) {
+	var ws []*waiter
+	rw.mux.Lock()
+	for id, w := range rw.m {
+		switch {
+		case !w.resume:
+			delete(rw.m, id)
+			w.fn(nil, ErrConnIsClosed)
+			ws = append(ws, w)
+		case w.sent && !w.idem:
+			delete(rw.m, id)
+			w.fn(nil, ErrConnLost)
+		default:
+			// Request will be sent again on the new net.Conn
+			w.queued, w.sent = false, false
+		}
+	}
+	rw.mux.Unlock()
+	return waiterMsgs(ws)
+}
+
+// Requeue returns the requests which are waiting to be sent on a new net.Conn, they are marked as queued
+// Note: Requests are returned in the order they were first sent
+func (rw *reqWait) Requeue() (ms []msg) {
+	var ws []*waiter
+	rw.mux.Lock()
+	for _, w := range rw.m {
+		if w.resume && !w.queued {
+			w.queued = true
+			ws = append(ws, w)
+		}
+	}
+	rw.mux.Unlock()
+	return waiterMsgs(ws)
+}
+
 // Dump clear our current reqWait list. Intended to be used on close by the parent
-func (rw *reqWait) Dump() {
+// Note: The dumped requests are returned, oldest first
+func (rw *reqWait) Dump() (ms []msg) {
+	var ws []*waiter
 	rw.mux.Lock()
-	for _, fn := range rw.m {
+	for _, w := range rw.m {
 		// Dumping all waiting functions with nil
-		fn(nil)
+		w.fn(nil, ErrConnIsClosed)
+		ws = append(ws, w)
 	}
 
 	// Replace map completely
-	rw.m = make(map[uuid.UUID]ReqFunc)
+	rw.m = make(map[uuid.UUID]*waiter)
 	rw.mux.Unlock()
+	return waiterMsgs(ws)
+}
+
+// waiterMsgs returns the request messages of the provided waiters, in the order they were first sent
+func waiterMsgs(ws []*waiter) (ms []msg) {
+	sort.Slice(ws, func(i, j int) bool { return ws[i].seq < ws[j].seq })
+	ms = make([]msg, len(ws))
+	for i, w := range ws {
+		ms[i] = w.m
+	}
+
+	return
 }
@@ -1,33 +1,95 @@
 package mq
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/missionMeteora/jump/chanchan"
+	"github.com/missionMeteora/jump/uuid"
 	"github.com/missionMeteora/toolkit/errors"
 )
 
+const (
+	// defaultHandshakeTimeout is the time allowed for clients to complete the handshake when none has been configured
+	defaultHandshakeTimeout = time.Second * 10
+	// defaultMaxPendingHandshakes is the number of concurrent pending handshakes allowed when none has been configured
+	defaultMaxPendingHandshakes = 128
+)
+
 // NewServer returns a pointer to a new instance of Server
 func NewServer(opts ServerOpts) (srv *Server, err error) {
+	co := newConnOpts(opts.Heartbeat, opts.HeartbeatMisses, opts.MaxBodySize)
+	co.setWorkers(opts.Workers, opts.OrderedStatements)
+	co.mws = opts.Middleware
+	co.dl = opts.DeadLetters
+	co.setAcks(opts.AckTimeout, opts.AckRetries)
+	// Clients restore their subscriptions after reconnecting
+	co.resetSubs = true
+
 	s := Server{
 		a:    newAuth(),
-		c:    newConns(),
+		c:    newConns(co),
 		op:   opts.Op,
 		errC: chanchan.NewChanChan(4, 12, chanchan.FullPush),
+		done: make(chan struct{}),
+		anyC: make(chan anyMsg),
+		g:    newGroups(),
 	}
 
 	if s.id, err = NewChunkFromString(opts.Name); err != nil {
 		return
 	}
 
+	s.reqChallenge = opts.RequireChallenge
+
+	if s.hsTimeout = opts.HandshakeTimeout; s.hsTimeout <= 0 {
+		s.hsTimeout = defaultHandshakeTimeout
+	}
+
+	if opts.MaxPendingHandshakes <= 0 {
+		opts.MaxPendingHandshakes = defaultMaxPendingHandshakes
+	}
+
+	s.hsSema = make(chan struct{}, opts.MaxPendingHandshakes)
+
+	if s.minVer = opts.MinProtocolVersion; s.minVer > protoCurrent {
+		// We cannot require a version newer than we support
+		return nil, &VersionError{Version: s.minVer, Min: protoV1, Max: protoCurrent}
+	}
+
+	if s.au = opts.Auth; s.au == nil {
+		// Authenticator was not provided, use our auth manager
+		s.au = s.a
+	}
+
+	if s.certAuth = opts.CertAuth; s.certAuth && opts.TLS == nil {
+		// Certificate authentication cannot be performed without TLS
+		return nil, ErrTLSRequired
+	}
+
 	for _, kt := range opts.Clients {
 		s.PutAuth(kt.Key, kt.Token)
 	}
 
+	if opts.Routing {
+		// Route messages between clients using our connections
+		s.c.co.route = s.route
+	}
+
+	if len(opts.SpoolPath) > 0 {
+		// Durable mode, statements to keys which are not connected are spooled
+		if s.c.sp, err = newSpool(opts.SpoolPath, opts.SpoolMaxSize, opts.SpoolMaxAge); err != nil {
+			return nil, err
+		}
+	}
+
 	// Listen at provided location
-	if s.l, err = net.Listen("tcp", opts.Loc); err != nil {
+	if s.l, err = listen(opts); err != nil {
 		// Error encountered while attempting to listen, return err
 		return nil, err
 	}
@@ -44,86 +106,304 @@ type Server struct {
 
 	id Chunk
 
-	// Auth manager
+	// Auth manager, used by PutAuth, GetAuth and DeleteAuth
 	a *auth
+	// Authenticator for connecting clients, defaults to the auth manager
+	au Authenticator
 	// Connections manager
 	c *conns
+	// Queue groups manager
+	g *groups
 	// Error channel
 	errC *chanchan.ChanChan
 
-	// Handshake buffer
-	hsBuf [32]byte
+	// Handshake slots, limits the number of pending handshakes
+	hsSema chan struct{}
+	// Time allowed for clients to complete the handshake
+	hsTimeout time.Duration
+	// Handshake counters
+	hss handshakeStats
 
 	// Operator for handling connection and disconnections
 	op Operator
 
+	// When true, clients are authenticated by their verified certificate rather than their token
+	certAuth bool
+	// When true, clients sending their raw token are rejected in favor of challenge-response
+	reqChallenge bool
+	// Minimum protocol version accepted from clients
+	minVer uint8
+
+	// Closed when the server is closed, used to release Serve
+	done chan struct{}
+	// Inbound messages from every client, used by ReceiveAny
+	anyC chan anyMsg
+	// Ensures ReceiveAny only starts serving once
+	anyOnce sync.Once
 	// Closed state, one represents closed
 	closed uint32
 }
 
+// listen returns a net.Listener for the provided options, TLS is used when a TLS configuration exists
+func listen(opts ServerOpts) (l net.Listener, err error) {
+	if opts.TLS == nil {
+		return net.Listen("tcp", opts.Loc)
+	}
+
+	cfg := opts.TLS
+	if opts.CertAuth && cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		// Certificate authentication requires every client to provide a verified certificate
+		cfg = cfg.Clone()
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.Listen("tcp", opts.Loc, cfg)
+}
+
 // Listener processes inbound TCP connections
 func (s *Server) listener() {
 	var (
 		nc  net.Conn
 		err error
-
-		// Handshake to be used within the loop
-		hs handshake
-		ok bool
 	)
 
 	// Loop while server is open
 	for !s.isClosed() {
-		if nc, err = s.l.Accept(); err != nil {
-			continue
+		// Acquire a handshake slot, this will block while the maximum number of handshakes are pending
+		select {
+		case s.hsSema <- struct{}{}:
+		case <-s.done:
+			// Server has been closed while waiting for a handshake slot
+			return
 		}
 
-		if hs, ok = s.handshake(nc); !ok {
-			// Invalid message header provided, send a message with a status of Invalid
-			sendMsg(nc, mtStatement, statusInvalid, nil)
-			nc.Close()
+		if nc, err = s.l.Accept(); err != nil {
+			// Release our handshake slot
+			<-s.hsSema
 			continue
 		}
 
-		if !s.a.IsValid(hs) {
-			// Credentials are invalid, send a message with a status of Forbidden
-			sendMsg(nc, mtStatement, statusForbidden, nil)
+		// Perform handshake within a new go routine so that slow clients cannot block other clients
+		go func(nc net.Conn) {
+			atomic.AddInt64(&s.hss.pending, 1)
+			s.accept(nc)
+			atomic.AddInt64(&s.hss.pending, -1)
+			// Release our handshake slot
+			<-s.hsSema
+		}(nc)
+	}
+}
+
+// accept will perform the handshake for an inbound net.Conn and, if successful, add it to our connections
+func (s *Server) accept(nc net.Conn) {
+	var (
+		// Handshake and connection metadata
+		hs   Handshake
+		meta interface{}
+		ok   bool
+		err  error
+	)
+
+	// The handshake must be completed before the handshake timeout
+	nc.SetDeadline(time.Now().Add(s.hsTimeout))
+
+	if hs, err = s.handshake(nc); err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// Client did not complete the handshake in time
+			atomic.AddUint64(&s.hss.timedOut, 1)
 			nc.Close()
-			continue
+			return
 		}
 
-		if err = s.c.Put(hs.key, nc, s.op, s.errC); err != nil {
-			// Error encountered while putting, return error to connecting client
-			sendMsg(nc, mtStatement, statusError, []byte(err.Error()))
-			nc.Close()
-			continue
+		// Invalid message header provided, send a message with a status of Invalid
+		atomic.AddUint64(&s.hss.invalid, 1)
+		sendMsg(nc, hs.Version, mtStatement, statusInvalid, nil)
+		nc.Close()
+		return
+	}
+
+	if hs.Version < s.minVer {
+		// Protocol version is not supported, send a message with a status of Version
+		atomic.AddUint64(&s.hss.rejected, 1)
+		sendMsg(nc, hs.Version, mtStatement, statusVersion, newVersionResp(s.minVer, protoCurrent))
+		nc.Close()
+		return
+	}
+
+	if meta, ok = s.authenticate(nc, &hs); !ok {
+		// Credentials are invalid, send a message with a status of Forbidden
+		atomic.AddUint64(&s.hss.rejected, 1)
+		sendMsg(nc, hs.Version, mtStatement, statusForbidden, nil)
+		nc.Close()
+		return
+	}
+
+	p := proto{ver: hs.Version, caps: hs.caps}
+	if s.c.co.route == nil {
+		// Routing is disabled, clients must not forward messages through us
+		p.caps &^= capRoute
+	}
+
+	if err = s.c.Put(hs.Key, nc, p, s.op, meta, s.errC, func() (err error) {
+		// Connection successful, send server's ID (and the negotiated protocol for versioned clients) to client
+		if err = sendMsg(nc, hs.Version, mtStatement, statusOK, newHelloResp(s.id, p)); err != nil {
+			return
 		}
 
-		// Connection successful, send server's ID to client
-		sendMsg(nc, mtStatement, statusOK, s.id[:])
+		// Handshake is complete, remove the deadline before the connection is handed off
+		return nc.SetDeadline(time.Time{})
+	}); err != nil {
+		// Error encountered while putting, return error to connecting client
+		atomic.AddUint64(&s.hss.rejected, 1)
+		sendMsg(nc, hs.Version, mtStatement, statusError, []byte(err.Error()))
+		nc.Close()
+		return
 	}
+
+	atomic.AddUint64(&s.hss.accepted, 1)
 }
 
-func (s *Server) handshake(c net.Conn) (h handshake, ok bool) {
+func (s *Server) handshake(c net.Conn) (h Handshake, err error) {
+	var (
+		buf   [32]byte // Handshake buffer
+		tkn   Chunk
+		p     proto
+		ver   uint8
+		flags uint8
+		caps  uint32
+		hello bool
+	)
+
+	h.Version = protoV1
+
 	// Read the handshake using our handshake buffer
-	if n, err := io.ReadFull(c, s.hsBuf[:]); err != nil || n != 32 {
+	if _, err = io.ReadFull(c, buf[:]); err != nil {
 		// Error exists OR handshake length was invalid, return early
 		return
 	}
 
-	// Return handshake from bytes in the buffer and set ok to true
-	h.key, _ = NewChunk(s.hsBuf[0:16])
-	h.token, _ = NewChunk(s.hsBuf[16:32])
-	ok = true
+	// Return handshake from bytes in the buffer
+	h.Key, _ = NewChunk(buf[0:16])
+	tkn, _ = NewChunk(buf[16:32])
+	h.Addr = c.RemoteAddr()
+
+	switch ver, flags, caps, hello = parseHello(tkn); {
+	case hello:
+		// Client supports versioning, negotiate the protocol version and capabilities
+		p = negotiate(ver, caps)
+		h.Version, h.caps = p.ver, p.caps
+		if h.Challenge = flags&helloChallenge != 0; h.Challenge {
+			break
+		}
+
+		// Client is sending it's raw token directly after the hello
+		_, err = io.ReadFull(c, h.Token[:])
+		return
+	case tkn == hsChallenge:
+		// Legacy client requested a challenge-response handshake
+		h.Challenge = true
+	default:
+		// Legacy client sent it's raw token, set token and return
+		h.Token = tkn
+		return
+	}
+
+	// Client requested a challenge-response handshake, send a nonce and read the resulting HMAC
+	if h.Nonce, err = newNonce(); err != nil {
+		return
+	}
+
+	if err = sendMsg(c, h.Version, mtStatement, statusChallenge, h.Nonce); err != nil {
+		return
+	}
+
+	h.MAC = make([]byte, macLen)
+	_, err = io.ReadFull(c, h.MAC)
 	return
 }
 
+// authenticate will validate the provided handshake using the server's Authenticator. When certificate
+// authentication is enabled, the handshake key is first replaced by the key represented by the client's certificate
+func (s *Server) authenticate(nc net.Conn, hs *Handshake) (meta interface{}, ok bool) {
+	if s.certAuth {
+		var key Chunk
+		if key, ok = certKey(nc); !ok {
+			// Client did not provide a verified certificate
+			return
+		}
+
+		if hs.Key != (Chunk{}) && hs.Key != key {
+			// Client provided a key which does not match it's certificate
+			return nil, false
+		}
+
+		hs.Key = key
+		hs.Verified = true
+	} else if s.reqChallenge && !hs.Challenge {
+		// Raw tokens are no longer accepted
+		return
+	}
+
+	if s.a.IsRevoked(hs.Key) {
+		// Key has been revoked, it is rejected regardless of the Authenticator
+		return
+	}
+
+	return s.au.Authenticate(*hs)
+}
+
+// handshakeStats holds the handshake counters of a Server, all fields are accessed atomically
+type handshakeStats struct {
+	accepted uint64
+	rejected uint64
+	invalid  uint64
+	timedOut uint64
+	pending  int64
+}
+
+// get returns a snapshot of the counters
+func (h *handshakeStats) get() (hs HandshakeStats) {
+	hs.Accepted = atomic.LoadUint64(&h.accepted)
+	hs.Rejected = atomic.LoadUint64(&h.rejected)
+	hs.Invalid = atomic.LoadUint64(&h.invalid)
+	hs.TimedOut = atomic.LoadUint64(&h.timedOut)
+	hs.Pending = atomic.LoadInt64(&h.pending)
+	return
+}
+
+// HandshakeStats are the handshake counters of a Server
+type HandshakeStats struct {
+	// Handshakes which completed successfully
+	Accepted uint64
+	// Handshakes rejected for invalid credentials, unsupported protocol versions or duplicate connections
+	Rejected uint64
+	// Handshakes which were malformed or failed while reading
+	Invalid uint64
+	// Handshakes which were not completed before the handshake timeout
+	TimedOut uint64
+	// Handshakes currently in progress
+	Pending int64
+}
+
 func (s *Server) isClosed() bool {
 	// Is s.closed set to one? If so, we are closed
 	return atomic.LoadUint32(&s.closed) == 1
 }
 
+// Meta will return the metadata provided by the Authenticator for a connection with a matching key
+func (s *Server) Meta(key string) (meta interface{}, ok bool) {
+	var c *conn
+	kC, _ := NewChunkFromString(key)
+	if c, ok = s.c.Get(kC); !ok {
+		// Connection does not exist, return early
+		return
+	}
+
+	return c.getMeta(), true
+}
+
 // GetAuth will return the token for a matching key
+// Note: Auth methods only apply to the default Authenticator
 func (s *Server) GetAuth(key string) (str string, ok bool) {
 	var tkn Chunk
 	keyC, _ := NewChunkFromString(key)
@@ -139,6 +419,7 @@ func (s *Server) GetAuth(key string) (str string, ok bool) {
 }
 
 // PutAuth will put a token as the value for a matching key
+// Note: Keys which were revoked are restored, see Restore
 func (s *Server) PutAuth(key, token string) (err error) {
 	var (
 		kC, tC Chunk
@@ -158,6 +439,7 @@ func (s *Server) PutAuth(key, token string) (err error) {
 }
 
 // DeleteAuth will delete the entry matching key (if exists)
+// Note: Active connections are not affected, see Revoke
 func (s *Server) DeleteAuth(key string) {
 	// Convert key to Chunk
 	kC, _ := NewChunkFromString(key)
@@ -165,13 +447,12 @@ func (s *Server) DeleteAuth(key string) {
 	s.a.Delete(kC)
 }
 
-// ListConns returns a list of keys for all the current conns
-func (s *Server) ListConns() []Chunk {
-	return s.c.List()
-}
-
-// Statement is used to send statements to a connection with the provided key
-func (s *Server) Statement(key string, b []byte) (err error) {
+// Revoke will delete the entry matching key (if exists) and close it's connection (if connected)
+// Note: The client is notified so that it will not attempt to reconnect. Operators implementing
+// ReasonOperator will receive ErrRevoked as the disconnect reason. The key remains revoked, it is
+// rejected before the Authenticator (including certificate authentication) is called until it is
+// restored by Restore or PutAuth
+func (s *Server) Revoke(key string) (err error) {
 	var (
 		c  *conn
 		ok bool
@@ -182,14 +463,66 @@ func (s *Server) Statement(key string, b []byte) (err error) {
 		return
 	}
 
-	// Get connection
+	// Call revoke on auth
+	s.a.Revoke(kC)
+
 	if c, ok = s.c.Get(kC); !ok {
-		// Connection does not exist, return ErrConnDoesNotExist
-		return ErrConnDoesNotExist
+		// Connection does not exist, nothing else to do
+		return
+	}
+
+	s.c.Delete(kC)
+	if err = c.revoke(); err == ErrConnIsClosed {
+		// Connection was not active, this is not an error
+		err = nil
+	}
+
+	return
+}
+
+// Restore will allow a revoked key to connect again, the Authenticator is called for it once more
+// Note: The token of a revoked key is not restored, see PutAuth
+func (s *Server) Restore(key string) (err error) {
+	var kC Chunk
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
+	}
+
+	s.a.Restore(kC)
+	return
+}
+
+// HandshakeStats returns the current handshake counters
+func (s *Server) HandshakeStats() HandshakeStats {
+	return s.hss.get()
+}
+
+// ListConns returns a list of keys for all the current conns
+func (s *Server) ListConns() []Chunk {
+	return s.c.List()
+}
+
+// Statement is used to send statements to a connection with the provided key
+func (s *Server) Statement(key string, b []byte) (err error) {
+	var kC Chunk
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
 	}
 
-	// Return any error encountered while calling c.Statement
-	return c.Statement(b)
+	// Return any error encountered while sending (or spooling) the statement
+	return s.undeliverable(kC, msg{uuid.New(), mtStatement, statusOK, b}, s.c.Statement(kC, b, s.isKnown(kC)))
+}
+
+// isKnown returns whether or not the provided key may connect, statements to known keys are spooled even if
+// they have not yet connected
+// Note: The Authenticator decides when it implements KeyAuthenticator, otherwise keys with a token are known
+func (s *Server) isKnown(key Chunk) bool {
+	if ka, ok := s.au.(KeyAuthenticator); ok {
+		return ka.KnownKey(key)
+	}
+
+	_, known := s.a.Get(key)
+	return known
 }
 
 // StatementAll is used to send statements to all active connections
@@ -203,6 +536,260 @@ func (s *Server) StatementAll(b []byte) error {
 	return errs.Err()
 }
 
+// Publish is used to send a statement to every client subscribed to a pattern matching the provided topic
+// Note: Topics consist of tokens separated by dots and cannot contain wildcards
+func (s *Server) Publish(topic string, b []byte) (err error) {
+	if !validTopic(topic, false) {
+		return ErrInvalidTopic
+	}
+
+	var body []byte
+	if body, err = NewMethodMsg(topic, b); err != nil {
+		return
+	}
+
+	var errs errors.ErrorList
+	s.c.ForEach(func(_ Chunk, c *conn) error {
+		if _, ok := c.subs.Match(topic); ok && c.isConnected() {
+			errs.Push(c.publish(body))
+		}
+
+		return nil
+	})
+
+	return errs.Err()
+}
+
+// route will forward a message from one client to the client whose key prefixes the body. The
+// response to a forwarded request is sent back to the requesting client using the original id
+// Note: Requests for a target which is not connected are answered with ErrTargetOffline
+func (s *Server) route(from *conn, m msg) (err error) {
+	if len(m.body) < 16 {
+		return ErrInvalidMsgLength
+	}
+
+	var (
+		key Chunk
+		to  *conn
+		ok  bool
+	)
+
+	copy(key[:], m.body[:16])
+	if ra, ok := s.au.(RouteAuthenticator); ok && !ra.AuthorizeRoute(from.id, key) {
+		// Sending client is not allowed to reach the target
+		return s.unroutable(from, m, ErrRouteForbidden)
+	}
+
+	if to, ok = s.c.Get(key); !ok || !to.isConnected() {
+		return s.unroutable(from, m, ErrTargetOffline)
+	}
+
+	fm := msg{id: uuid.New(), t: m.t, s: statusForwarded, body: m.body}
+	if to.hasCap(capRoute) {
+		// Replace the target key with the key of the sending client
+		copy(fm.body[:16], from.id[:])
+	} else {
+		// Target does not understand forwarded messages, send the body as a regular message
+		fm.s = statusOK
+		fm.body = m.body[16:]
+	}
+
+	if m.t != mtRequest {
+		return to.out.Put(fm)
+	}
+
+	return to.request(fm, func(b []byte, err error) {
+		if _, ok := err.(ResponseError); err != nil && !ok {
+			// Target was disconnected before responding
+			err = ErrTargetOffline
+		}
+
+		from.respond(m.id, b, err)
+	}, false)
+}
+
+// unroutable will notify the sending client that a forwarded message could not be delivered. Requests are
+// answered with reason, statements are returned with statusUndeliverable so that the client can keep them
+// Body layout of undeliverable statements:
+//   - Reason: created by NewMethodMsg, followed by
+//   - Forwarded body: target key followed by the original body
+func (s *Server) unroutable(from *conn, m msg, reason ResponseError) (err error) {
+	if m.t == mtRequest {
+		return from.respond(m.id, nil, reason)
+	}
+
+	var body []byte
+	if body, err = NewMethodMsg(string(reason), m.body); err != nil {
+		return
+	}
+
+	return from.send(msg{m.id, mtStatement, statusUndeliverable, body})
+}
+
+// JoinGroup will add the provided key to a queue group, the group is created when it does not exist
+// Note: Keys remain members while disconnected, they are skipped until they reconnect
+func (s *Server) JoinGroup(group, key string) (err error) {
+	var kC Chunk
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
+	}
+
+	s.g.Join(group, kC)
+	return
+}
+
+// LeaveGroup will remove the provided key from a queue group
+func (s *Server) LeaveGroup(group, key string) (err error) {
+	var kC Chunk
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
+	}
+
+	s.g.Leave(group, kC)
+	return
+}
+
+// GroupMembers returns the keys of the members of a queue group
+func (s *Server) GroupMembers(group string) []Chunk {
+	return s.g.Members(group)
+}
+
+// StatementGroup is used to send a statement to one connected member of a queue group
+func (s *Server) StatementGroup(group string, b []byte) (err error) {
+	skip := make(map[Chunk]struct{})
+	for {
+		var c *conn
+		if c, err = s.g.Pick(group, s.c, skip); err != nil {
+			return
+		}
+
+		if err = c.send(msg{uuid.New(), mtStatement, statusOK, b}); err == nil {
+			return
+		}
+
+		// Member could not be sent to, try another
+		skip[c.id] = struct{}{}
+	}
+}
+
+// RequestGroup is used to send a request to one connected member of a queue group, the member with the fewest
+// requests in flight is chosen. When the member disconnects before responding, the request is sent to another
+// Note: fn is called with ErrNoGroupMembers when no other members are connected
+func (s *Server) RequestGroup(group string, b []byte, fn ReqErrFunc) error {
+	return s.requestGroup(newGroupReq(group, b, fn))
+}
+
+// RequestGroupCtx is used to send a request to one connected member of a queue group, it will block until the
+// response is received. See RequestGroup for details
+func (s *Server) RequestGroupCtx(ctx context.Context, group string, b []byte) (resp []byte, err error) {
+	var gr *groupReq
+	return waitResp(ctx, func(fn ReqErrFunc) error {
+		gr = newGroupReq(group, b, fn)
+		return s.requestGroup(gr)
+	}, func() {
+		// Remove the pending request so it does not linger until the member disconnects
+		gr.cancel()
+	})
+}
+
+// requestGroup will send a group request to a member of it's queue group which has not been skipped
+func (s *Server) requestGroup(gr *groupReq) (err error) {
+	gr.mux.Lock()
+	defer gr.mux.Unlock()
+
+	for !gr.cancelled {
+		var c *conn
+		if c, err = s.g.Pick(gr.group, s.c, gr.skip); err != nil {
+			return
+		}
+
+		m := msg{uuid.New(), mtRequest, statusOK, gr.b}
+		gr.c, gr.id = c, m.id
+		atomic.AddInt32(&c.inflight, 1)
+		if err = c.request(m, func(resp []byte, err error) {
+			atomic.AddInt32(&c.inflight, -1)
+			if err == ErrConnIsClosed && !s.isClosed() {
+				// Member disconnected before responding, retry with another member
+				// Note: The retry is within a new go routine because the conn's locks are held while we are called
+				go s.retryGroup(gr, c.id)
+				return
+			}
+
+			gr.fn(resp, err)
+		}, false); err == nil {
+			return
+		}
+
+		// Member could not be sent to, try another
+		atomic.AddInt32(&c.inflight, -1)
+		gr.skip[c.id] = struct{}{}
+	}
+
+	return
+}
+
+// retryGroup will send a group request to another member after the member with the provided key disconnected
+func (s *Server) retryGroup(gr *groupReq, key Chunk) {
+	gr.mux.Lock()
+	gr.skip[key] = struct{}{}
+	gr.mux.Unlock()
+
+	if err := s.requestGroup(gr); err != nil {
+		gr.fn(nil, err)
+	}
+}
+
+// newGroupReq returns a pointer to a new instance of groupReq
+func newGroupReq(group string, b []byte, fn ReqErrFunc) *groupReq {
+	return &groupReq{
+		group: group,
+		b:     b,
+		fn:    fn,
+		skip:  make(map[Chunk]struct{}),
+	}
+}
+
+// groupReq is a request to a queue group, it is sent to another member when it's member disconnects before responding
+type groupReq struct {
+	mux sync.Mutex
+
+	group string
+	b     []byte
+	fn    ReqErrFunc
+
+	// Members which have been tried
+	skip map[Chunk]struct{}
+	// Member and message id of the pending request
+	c  *conn
+	id uuid.UUID
+	// True once the request has been cancelled, it will not be retried
+	cancelled bool
+}
+
+// cancel will remove the pending request from it's member and stop any further retries
+func (gr *groupReq) cancel() {
+	gr.mux.Lock()
+	gr.cancelled = true
+	if gr.c != nil {
+		if _, ok := gr.c.rw.Get(gr.id); ok {
+			// Response func will not be called, release the member's in-flight slot
+			atomic.AddInt32(&gr.c.inflight, -1)
+		}
+	}
+	gr.mux.Unlock()
+}
+
+// StatementAck is used to send an acknowledged statement to a connection with the provided key
+// Note: See Client.StatementAck for details
+func (s *Server) StatementAck(key string, b []byte) (err error) {
+	var c *conn
+	if c, err = s.getConn(key); err != nil {
+		return
+	}
+
+	return c.StatementAck(b)
+}
+
 // Request is used to send requests to a connection with the provided key
 func (s *Server) Request(key string, b []byte, fn ReqFunc) (err error) {
 	var (
@@ -217,13 +804,37 @@ func (s *Server) Request(key string, b []byte, fn ReqFunc) (err error) {
 
 	if c, ok = s.c.Get(kC); !ok {
 		// Connection does not exist, return ErrConnDoesNotExist
-		return ErrConnDoesNotExist
+		return s.undeliverable(kC, msg{uuid.New(), mtRequest, statusOK, b}, ErrConnDoesNotExist)
 	}
 
 	// Return any error encountered while calling c.Request
 	return c.Request(b, fn)
 }
 
+// RequestCtx is used to send a request to a connection with the provided key and wait for the response
+// Note: The context's error is returned when it's done before the response arrives. ErrConnIsClosed is
+// returned when the connection closes before the response arrives
+func (s *Server) RequestCtx(ctx context.Context, key string, b []byte) (resp []byte, err error) {
+	var c *conn
+	if c, err = s.getConn(key); err != nil {
+		return nil, s.undeliverableTo(key, mtRequest, b, err)
+	}
+
+	// Return the response and any error encountered while calling c.RequestCtx
+	return c.RequestCtx(ctx, b)
+}
+
+// RequestErr is used to send requests to a connection with the provided key, fn is called with an error when the response fails
+func (s *Server) RequestErr(key string, b []byte, fn ReqErrFunc) (err error) {
+	var c *conn
+	if c, err = s.getConn(key); err != nil {
+		return s.undeliverableTo(key, mtRequest, b, err)
+	}
+
+	// Return any error encountered while calling c.RequestErr
+	return c.RequestErr(b, fn)
+}
+
 // RequestAll is used to send statements to all active connections
 func (s *Server) RequestAll(b []byte, fn ReqFunc) error {
 	var errs errors.ErrorList
@@ -257,6 +868,203 @@ func (s *Server) Receive(key string, rec Receiver) (err error) {
 	return c.Receive(rec)
 }
 
+// ReceiveErr is used to receive inbound messages from the provided key using an ErrReceiver
+func (s *Server) ReceiveErr(key string, rec ErrReceiver) (err error) {
+	var c *conn
+	if c, err = s.getConn(key); err != nil {
+		return
+	}
+
+	// Return any error encountered while calling c.ReceiveErr
+	return c.ReceiveErr(rec)
+}
+
+// Serve will process inbound messages from every client using the provided KeyReceiver, the key of the
+// sending client is passed along with each message. Serve blocks until the server is closed
+// Note: Receivers can be served by wrapping them with IgnoreKey. Serve should not be mixed with
+// Receive, calling Serve again will replace the KeyReceiver
+func (s *Server) Serve(rec KeyReceiver) error {
+	if s.isClosed() {
+		return ErrServerIsClosed
+	}
+
+	s.serve(rec)
+	<-s.done
+	return nil
+}
+
+// serve will set the serving KeyReceiver and start serving every connected client
+func (s *Server) serve(rec KeyReceiver) {
+	s.c.co.sr.set(rec)
+	// Start serving clients which are already connected, new connections are served once connected
+	s.c.ForEach(func(_ Chunk, c *conn) error {
+		if c.isConnected() {
+			c.startServe()
+		}
+
+		return nil
+	})
+}
+
+// ReceiveAny is used to receive the next inbound message from any client, the key of the sending client
+// is passed to the KeyReceiver. Responses are sent to the client which made the request
+// Note: Messages from each client are received in order when ServerOpts.Workers is zero. With workers, messages
+// are passed along concurrently, so only statements keep their order and only when ServerOpts.OrderedStatements
+// is set. ReceiveAny should not be mixed with Serve or Receive
+func (s *Server) ReceiveAny(rec KeyReceiver) (err error) {
+	if s.isClosed() {
+		return ErrServerIsClosed
+	}
+
+	// Serve every client with our anyRec, it passes inbound messages to anyC
+	s.anyOnce.Do(func() { s.serve(anyRec{s}) })
+
+	var am anyMsg
+	select {
+	case am = <-s.anyC:
+	case <-s.done:
+		return ErrServerIsClosed
+	}
+
+	if am.respC == nil {
+		rec.Statement(am.key, am.body)
+		return
+	}
+
+	var ar anyResp
+	ar.body, ar.err = rec.Response(am.key, am.body)
+	// Note: The response channel is buffered, so this never blocks
+	am.respC <- ar
+	return
+}
+
+// anyMsg is an inbound message waiting to be received by ReceiveAny
+type anyMsg struct {
+	// Key of the sending client
+	key  Chunk
+	body []byte
+	// Response channel, nil for statements
+	respC chan anyResp
+}
+
+// anyResp is the result of a request received by ReceiveAny
+type anyResp struct {
+	body []byte
+	err  error
+}
+
+// anyRec is a KeyReceiver which passes inbound messages to ReceiveAny
+// Note: Each client's serve loop waits for it's message to be received, which keeps messages in order
+type anyRec struct {
+	s *Server
+}
+
+// Response will pass the request to ReceiveAny and wait for the result
+func (r anyRec) Response(key Chunk, b []byte) ([]byte, error) {
+	am := anyMsg{key: key, body: b, respC: make(chan anyResp, 1)}
+	select {
+	case r.s.anyC <- am:
+	case <-r.s.done:
+		return nil, ErrServerIsClosed
+	}
+
+	select {
+	case ar := <-am.respC:
+		return ar.body, ar.err
+	case <-r.s.done:
+		return nil, ErrServerIsClosed
+	}
+}
+
+// Statement will pass the statement to ReceiveAny
+func (r anyRec) Statement(key Chunk, b []byte) {
+	select {
+	case r.s.anyC <- anyMsg{key: key, body: b}:
+	case <-r.s.done:
+	}
+}
+
+// undeliverable will keep a message for the provided key as a dead letter when reason is an undeliverable
+// error, reason is returned. Errors encountered while storing the dead letter are sent to the error chan
+// Note: Messages which reached a conn are kept by the conn
+func (s *Server) undeliverable(key Chunk, m msg, reason error) error {
+	if reason == nil || !isUndeliverable(reason) {
+		return reason
+	}
+
+	if err := s.c.co.deadLetter(newDeadLetter(key, m, reason)); err != nil {
+		s.errC.Send(err)
+	}
+
+	return reason
+}
+
+// undeliverableTo will keep a message for the provided key string as a dead letter, see undeliverable
+func (s *Server) undeliverableTo(key string, t msgType, b []byte, reason error) error {
+	kC, err := NewChunkFromString(key)
+	if err != nil {
+		return reason
+	}
+
+	return s.undeliverable(kC, msg{uuid.New(), t, statusOK, b}, reason)
+}
+
+// DeadLetters returns the messages which could not be delivered or processed, oldest first
+func (s *Server) DeadLetters() ([]DeadLetter, error) {
+	if s.c.co.dl == nil {
+		return nil, ErrNoDeadLetterSink
+	}
+
+	return s.c.co.dl.List()
+}
+
+// Replay will send a dead letter again and remove it from the dead-letter sink once it has been sent. fn is
+// called with the response to a replayed request, the response is discarded when fn is nil
+// Note: Replayed messages are sent by the server, including messages which were routed from another client.
+// The dead letter is kept when it cannot be sent, inbound dead letters cannot be replayed
+func (s *Server) Replay(id uuid.UUID, fn ReqErrFunc) (err error) {
+	var dl DeadLetter
+	if dl, err = replayable(s.c.co.dl, id); err != nil {
+		return
+	}
+
+	if dl.Request {
+		c, ok := s.c.Get(dl.Key)
+		if !ok {
+			return ErrConnDoesNotExist
+		}
+
+		err = c.request(msg{uuid.New(), mtRequest, statusOK, dl.Body}, replayFunc(fn), false)
+	} else {
+		err = s.c.Statement(dl.Key, dl.Body, s.isKnown(dl.Key))
+	}
+
+	if err != nil {
+		return
+	}
+
+	return s.c.co.dl.Delete(id)
+}
+
+// getConn will return the connection for the provided key
+func (s *Server) getConn(key string) (c *conn, err error) {
+	var (
+		ok bool
+		kC Chunk
+	)
+
+	if kC, err = NewChunkFromString(key); err != nil {
+		return
+	}
+
+	if c, ok = s.c.Get(kC); !ok {
+		// Connection does not exist, return ErrConnDoesNotExist
+		return nil, ErrConnDoesNotExist
+	}
+
+	return
+}
+
 // IsConnected will return whether or not a client (referenced by key) is connected
 func (s *Server) IsConnected(key string) (ok bool) {
 	kC, _ := NewChunkFromString(key)
@@ -264,6 +1072,11 @@ func (s *Server) IsConnected(key string) (ok bool) {
 	return
 }
 
+// ErrC returns a chanchan.Receiver interface which is backed by s.errC
+func (s *Server) ErrC() chanchan.Receiver {
+	return s.errC
+}
+
 // Close will close the server and return any error encountered in the process
 func (s *Server) Close() error {
 	if s == nil {
@@ -284,5 +1097,13 @@ func (s *Server) Close() error {
 		return nil
 	})
 
+	if s.c.sp != nil {
+		// Close spool
+		errs.Push(s.c.sp.Close())
+	}
+
+	// Release Serve
+	close(s.done)
+
 	return errs.Err()
 }
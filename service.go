@@ -0,0 +1,201 @@
+package mq
+
+import (
+	"context"
+	"reflect"
+	"sort"
+)
+
+// MethodsMethod is the method used to list the methods registered with a Mux, it is answered once a service
+// has been registered. The list is encoded using JSONCodec
+const MethodsMethod = "mq.Methods"
+
+// errorType is the reflect.Type of the error interface
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Register will register the exported methods of the provided service, using the name of it's type as the
+// service name. See RegisterName for details
+func (m *Mux) Register(rcvr interface{}) error {
+	return m.RegisterName("", rcvr, nil)
+}
+
+// RegisterName will register the exported methods of the provided service under the provided name. Methods
+// must be of the form Method(args T1, reply *T2) error, they are registered as "Name.Method"
+// Note: The type name is used when name is empty and DefaultCodec is used when cdc is nil. Methods of
+// other forms are ignored, ErrInvalidService is returned when rcvr is nil or no methods are suitable.
+// Callers must use the same codec, see CallMethod. No methods are registered when any method name
+// is longer than 255 bytes
+func (m *Mux) RegisterName(name string, rcvr interface{}, cdc Codec) (err error) {
+	if cdc == nil {
+		cdc = DefaultCodec
+	}
+
+	rv := reflect.ValueOf(rcvr)
+	if isNil(rv) {
+		// Methods cannot be called on a nil service
+		return ErrInvalidService
+	}
+
+	if len(name) == 0 {
+		name = reflect.Indirect(rv).Type().Name()
+	}
+
+	if len(name) == 0 {
+		return ErrInvalidService
+	}
+
+	rt := rv.Type()
+	hs := make(map[string]KeyReceiver)
+	for i := 0; i < rt.NumMethod(); i++ {
+		method := rt.Method(i)
+		if !isServiceMethod(method) {
+			continue
+		}
+
+		sm := name + "." + method.Name
+		if len(sm) > 255 {
+			// Method name cannot be sent, return before any method is registered
+			return ErrInvalidMethod
+		}
+
+		hs[sm] = &serviceMethod{rcvr: rv, fn: method.Func, args: method.Type.In(1), cdc: cdc}
+	}
+
+	if len(hs) == 0 {
+		return ErrInvalidService
+	}
+
+	for method, h := range hs {
+		if err = m.Handle(method, h); err != nil {
+			return
+		}
+	}
+
+	// Ensure the method list is available
+	return m.HandleFunc(MethodsMethod, func(_ Chunk, _ []byte) ([]byte, error) {
+		return JSONCodec.Marshal(m.Methods())
+	}, nil)
+}
+
+// Methods returns a sorted list of the methods which have a handler
+func (m *Mux) Methods() (l []string) {
+	m.mux.RLock()
+	l = make([]string, 0, len(m.m))
+	for method := range m.m {
+		l = append(l, method)
+	}
+	m.mux.RUnlock()
+
+	sort.Strings(l)
+	return
+}
+
+// isNil returns whether or not the provided value is nil, including typed nils
+func isNil(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	}
+
+	return false
+}
+
+// isServiceMethod returns whether or not the provided method is of the form Method(args T1, reply *T2) error
+func isServiceMethod(method reflect.Method) bool {
+	mt := method.Type
+	switch {
+	case len(method.PkgPath) > 0:
+		// Method is not exported
+		return false
+	case mt.NumIn() != 3 || mt.NumOut() != 1:
+		return false
+	case mt.In(2).Kind() != reflect.Ptr:
+		// Reply must be a pointer
+		return false
+	}
+
+	return mt.Out(0) == errorType
+}
+
+// serviceMethod is a KeyReceiver which calls a method of a registered service
+type serviceMethod struct {
+	// Service value and method func
+	rcvr reflect.Value
+	fn   reflect.Value
+	// Type of the args
+	args reflect.Type
+
+	cdc Codec
+}
+
+// Response will decode the args, call the method and encode the reply
+// Note: An error returned by the method is sent to the requester
+func (s *serviceMethod) Response(_ Chunk, b []byte) ([]byte, error) {
+	var argv reflect.Value
+	if s.args.Kind() == reflect.Ptr {
+		argv = reflect.New(s.args.Elem())
+	} else {
+		argv = reflect.New(s.args)
+	}
+
+	if err := s.cdc.Unmarshal(b, argv.Interface()); err != nil {
+		return nil, err
+	}
+
+	if s.args.Kind() != reflect.Ptr {
+		argv = argv.Elem()
+	}
+
+	reply := reflect.New(s.fn.Type().In(2).Elem())
+	if err, _ := s.fn.Call([]reflect.Value{s.rcvr, argv, reply})[0].Interface().(error); err != nil {
+		return nil, err
+	}
+
+	return s.cdc.Marshal(reply.Interface())
+}
+
+// Statement will call the method, the reply is discarded
+func (s *serviceMethod) Statement(key Chunk, b []byte) {
+	s.Response(key, b)
+}
+
+// CallMethod will call a method of a registered service, the reply is decoded into reply. cdc must be the codec
+// the service was registered with, DefaultCodec is used when cdc is nil
+// Note: serviceMethod is of the form "Service.Method", errors returned by the method are returned as a ResponseError
+func CallMethod(ctx context.Context, r Requester, serviceMethod string, args, reply interface{}, cdc Codec) (err error) {
+	if cdc == nil {
+		cdc = DefaultCodec
+	}
+
+	var b []byte
+	if b, err = cdc.Marshal(args); err != nil {
+		return
+	}
+
+	if b, err = NewMethodMsg(serviceMethod, b); err != nil {
+		return
+	}
+
+	if b, err = r.RequestCtx(ctx, b); err != nil {
+		return
+	}
+
+	return cdc.Unmarshal(b, reply)
+}
+
+// ListMethods returns the methods available through the provided Requester
+func ListMethods(ctx context.Context, r Requester) (l []string, err error) {
+	var b []byte
+	if b, err = NewMethodMsg(MethodsMethod, nil); err != nil {
+		return
+	}
+
+	if b, err = r.RequestCtx(ctx, b); err != nil {
+		return
+	}
+
+	err = JSONCodec.Unmarshal(b, &l)
+	return
+}
@@ -0,0 +1,162 @@
+package mq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/missionMeteora/iodb"
+	"github.com/missionMeteora/jump/uuid"
+)
+
+// newSpool returns a pointer to a new instance of spool, backed by an iodb.DB at the provided path
+func newSpool(path string, maxSize int64, maxAge time.Duration) (sp *spool, err error) {
+	sp = &spool{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		sizes:   make(map[Chunk]int64),
+		// Sequence starts at the current time so that entries remain ordered across restarts
+		seq: uint64(time.Now().UnixNano()),
+	}
+
+	if sp.db, err = iodb.New(path); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// spool stores statements for keys which are not connected, they are sent once the key reconnects
+// Note: Each key has a bucket of entries, entry keys are sequence numbers so that they are iterated in order
+type spool struct {
+	mux sync.Mutex
+
+	db *iodb.DB
+
+	// Maximum total size (in bytes) of the entries for each key, unlimited when zero
+	maxSize int64
+	// Maximum age of entries, entries which are older are discarded rather than sent. Unlimited when zero
+	maxAge time.Duration
+
+	// Total size of the entries for each key, loaded from the bucket when missing
+	sizes map[Chunk]int64
+	// Entry sequence, accessed atomically
+	seq uint64
+}
+
+// Entry layout:
+//   - Spooled at: 8 bytes (little-endian unix nanoseconds)
+//   - Body: remaining bytes
+
+// Put will store a statement for the provided key
+// Note: ErrSpoolFull is returned when the statement would exceed the maximum size for the key
+func (sp *spool) Put(key Chunk, b []byte) (err error) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+
+	var bkt *iodb.Bucket
+	if bkt, err = sp.db.CreateBucket("mq", key.String()); err != nil {
+		return
+	}
+
+	size, ok := sp.sizes[key]
+	if !ok {
+		// Size has not been loaded since starting, sum the existing entries
+		if size, err = bucketSize(bkt); err != nil {
+			return
+		}
+	}
+
+	if sp.maxSize > 0 && size+int64(len(b)) > sp.maxSize {
+		return &SpoolFullError{Key: key, Size: size, Max: sp.maxSize}
+	}
+
+	ek := fmt.Sprintf("%020d", atomic.AddUint64(&sp.seq, 1))
+	if err = bkt.Put(ek, func(w io.Writer) (err error) {
+		var ts [8]byte
+		binary.LittleEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+		if _, err = w.Write(ts[:]); err != nil {
+			return
+		}
+
+		_, err = w.Write(b)
+		return
+	}); err != nil {
+		return
+	}
+
+	sp.sizes[key] = size + int64(len(b))
+	return
+}
+
+// Flush will send the statements stored for the provided key to the conn in the order they were stored
+// Note: Entries which exceed the maximum age are discarded
+func (sp *spool) Flush(key Chunk, c *conn) (err error) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+
+	var bkt *iodb.Bucket
+	if bkt, err = sp.db.CreateBucket("mq", key.String()); err != nil {
+		return
+	}
+
+	var sent []string
+	err = bkt.ForEach(func(ek string, r io.Reader) (err error) {
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err != nil {
+			return
+		}
+
+		if len(b) < 8 {
+			// Entry is invalid, discard it
+			sent = append(sent, ek)
+			return
+		}
+
+		at := time.Unix(0, int64(binary.LittleEndian.Uint64(b[:8])))
+		if sp.maxAge <= 0 || time.Since(at) <= sp.maxAge {
+			if err = c.send(msg{uuid.New(), mtStatement, statusOK, b[8:]}); err != nil {
+				// Conn has closed, the remaining entries are sent once the key reconnects
+				return
+			}
+		}
+
+		sent = append(sent, ek)
+		return
+	})
+
+	for _, ek := range sent {
+		bkt.Delete(ek)
+	}
+
+	// Size will be loaded from the bucket on the next Put
+	delete(sp.sizes, key)
+	return
+}
+
+// Close will close the underlying iodb.DB
+func (sp *spool) Close() error {
+	return sp.db.Close()
+}
+
+// bucketSize returns the total size of the bodies stored within a bucket
+func bucketSize(bkt *iodb.Bucket) (size int64, err error) {
+	err = bkt.ForEach(func(_ string, r io.Reader) (err error) {
+		var n int64
+		if n, err = io.Copy(ioutil.Discard, r); err != nil {
+			return
+		}
+
+		if n > 8 {
+			size += n - 8
+		}
+
+		return
+	})
+
+	return
+}
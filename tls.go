@@ -0,0 +1,74 @@
+package mq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+)
+
+// newTLSConfig returns a tls.Config populated with the provided certificate, key and certificate authority files
+// Note: Empty paths are skipped. A nil config is returned when all paths are empty
+func newTLSConfig(certFile, keyFile, caFile string) (cfg *tls.Config, err error) {
+	if len(certFile) == 0 && len(keyFile) == 0 && len(caFile) == 0 {
+		// TLS has not been configured, return early
+		return
+	}
+
+	cfg = &tls.Config{}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(caFile) > 0 {
+		var (
+			pem  []byte
+			pool = x509.NewCertPool()
+		)
+
+		if pem, err = ioutil.ReadFile(caFile); err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCA
+		}
+
+		// The same pool is used to verify servers (as a client) and clients (as a server)
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+	}
+
+	return
+}
+
+// certKey returns the key represented by the verified client certificate of the provided net.Conn
+// Note: ok will be false for non-TLS connections and connections without a verified client certificate
+func certKey(nc net.Conn) (key Chunk, ok bool) {
+	tc, isTLS := nc.(*tls.Conn)
+	if !isTLS {
+		return
+	}
+
+	cs := tc.ConnectionState()
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		// Certificate was not provided or was not verified, return early
+		return
+	}
+
+	// The common name of the leaf certificate is used as the key
+	// Note: Common names longer than a key are rejected rather than truncated, otherwise
+	// distinct certificates could share a key
+	var err error
+	if key, err = NewChunkFromString(cs.PeerCertificates[0].Subject.CommonName); err != nil || key == (Chunk{}) {
+		return Chunk{}, false
+	}
+
+	ok = true
+	return
+}